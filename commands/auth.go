@@ -0,0 +1,187 @@
+package commands
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"hash"
+	"strings"
+)
+
+// authScheme returns the credentials of the Authorization header if it
+// uses scheme.
+func (x *HttpRequest) authScheme(scheme string) (string, bool) {
+	auth := x.GetHeaderValue("Authorization")
+	if len(auth) <= len(scheme) || !strings.EqualFold(auth[:len(scheme)], scheme) || auth[len(scheme)] != ' ' {
+		return "", false
+	}
+
+	return strings.TrimSpace(auth[len(scheme)+1:]), true
+}
+
+// BearerToken returns the token of a "Bearer" Authorization header.
+func (x *HttpRequest) BearerToken() (string, bool) {
+	token, ok := x.authScheme("Bearer")
+	if !ok || token == "" {
+		return "", false
+	}
+
+	return token, true
+}
+
+// APIKey returns the key from the header, if given, or else from the query
+// parameter, if given.
+func (x *HttpRequest) APIKey(header, param string) (string, bool) {
+	if header != "" {
+		if key := x.GetHeaderValue(header); key != "" {
+			return key, true
+		}
+	}
+	if param != "" {
+		if key := x.QueryValue(param); key != "" {
+			return key, true
+		}
+	}
+
+	return "", false
+}
+
+// DigestCredentials are the parameters of a "Digest" Authorization header
+// (RFC 7616).
+type DigestCredentials struct {
+	Username  string
+	Realm     string
+	Nonce     string
+	URI       string
+	Response  string
+	Algorithm string
+	QOP       string
+	NC        string
+	CNonce    string
+	Opaque    string
+}
+
+// DigestAuth parses a "Digest" Authorization header.
+func (x *HttpRequest) DigestAuth() (*DigestCredentials, bool) {
+	auth, ok := x.authScheme("Digest")
+	if !ok {
+		return nil, false
+	}
+
+	params, ok := parseAuthParams(auth)
+	if !ok {
+		return nil, false
+	}
+	d := &DigestCredentials{
+		Username:  params["username"],
+		Realm:     params["realm"],
+		Nonce:     params["nonce"],
+		URI:       params["uri"],
+		Response:  params["response"],
+		Algorithm: params["algorithm"],
+		QOP:       params["qop"],
+		NC:        params["nc"],
+		CNonce:    params["cnonce"],
+		Opaque:    params["opaque"],
+	}
+	if d.Username == "" || d.Nonce == "" || d.URI == "" || d.Response == "" {
+		return nil, false
+	}
+
+	return d, true
+}
+
+// parseAuthParams parses a comma separated list of name=value pairs where
+// values may be quoted strings with backslash escapes.
+func parseAuthParams(s string) (map[string]string, bool) {
+	params := map[string]string{}
+	for {
+		s = strings.TrimLeft(s, " \t,")
+		if s == "" {
+			return params, true
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, false
+		}
+		name := strings.ToLower(strings.TrimSpace(s[:eq]))
+		s = strings.TrimLeft(s[eq+1:], " \t")
+
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			var b strings.Builder
+			i := 1
+			for ; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			if i == len(s) {
+				return nil, false
+			}
+			value, s = b.String(), s[i+1:]
+		} else {
+			end := strings.IndexByte(s, ',')
+			if end < 0 {
+				end = len(s)
+			}
+			value, s = strings.TrimSpace(s[:end]), s[end:]
+		}
+		params[name] = value
+	}
+}
+
+func digestHash(algorithm string) (func() hash.Hash, bool) {
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(algorithm), "-sess")) {
+	case "", "MD5":
+		return md5.New, true
+	case "SHA-256":
+		return sha256.New, true
+	}
+	return nil, false
+}
+
+func hexHash(h func() hash.Hash, parts ...string) string {
+	d := h()
+	d.Write([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(d.Sum(nil))
+}
+
+// DigestHA1 returns H(username:realm:password), the value password files
+// such as htdigest store.
+func DigestHA1(algorithm, username, realm, password string) string {
+	h, ok := digestHash(algorithm)
+	if !ok {
+		return ""
+	}
+	return hexHash(h, username, realm, password)
+}
+
+// Verify checks the response of d for a request with the given method,
+// given ha1 as returned by DigestHA1. Only the "auth" quality of protection
+// is supported. The nonce is not checked; that is up to the caller.
+func (d *DigestCredentials) Verify(method, ha1 string) bool {
+	h, ok := digestHash(d.Algorithm)
+	if !ok || ha1 == "" {
+		return false
+	}
+	if strings.HasSuffix(strings.ToLower(d.Algorithm), "-sess") {
+		ha1 = hexHash(h, ha1, d.Nonce, d.CNonce)
+	}
+	ha2 := hexHash(h, method, d.URI)
+
+	var want string
+	switch d.QOP {
+	case "":
+		want = hexHash(h, ha1, d.Nonce, ha2)
+	case "auth":
+		want = hexHash(h, ha1, d.Nonce, d.NC, d.CNonce, d.QOP, ha2)
+	default:
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(want), []byte(strings.ToLower(d.Response))) == 1
+}
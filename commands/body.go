@@ -0,0 +1,249 @@
+package commands
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/url"
+	"sync"
+)
+
+const DefaultMaxBodySize = 10 << 20
+
+var (
+	ErrorBodyTooLarge = errors.New("body too large")
+	ErrorBodyUuid     = errors.New("body chunk for another request")
+)
+
+// BodyReader assembles a body from its BodyChunk frames. Push is called from
+// the connection's command callback and never blocks; Read blocks until data
+// or the final chunk arrives.
+type BodyReader struct {
+	uuid   string
+	limit  int64
+	mu     sync.Mutex
+	cond   *sync.Cond
+	chunks [][]byte
+	size   int64
+	eof    bool
+	err    error
+}
+
+// NewBodyReader returns a reader for the body of the request or response
+// with the given uuid. At most limit bytes are buffered; zero means
+// DefaultMaxBodySize.
+func NewBodyReader(uuid string, limit int64) *BodyReader {
+	if limit <= 0 {
+		limit = DefaultMaxBodySize
+	}
+	b := &BodyReader{uuid: uuid, limit: limit}
+	b.cond = sync.NewCond(&b.mu)
+
+	return b
+}
+
+// Push adds a chunk. Its body is copied, so the chunk may be reused.
+func (b *BodyReader) Push(c *BodyChunk) error {
+	if c.GetUuid() != b.uuid {
+		return ErrorBodyUuid
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.eof || b.err != nil {
+		return b.err
+	}
+
+	b.size += int64(len(c.GetBody()))
+	if b.size > b.limit {
+		b.chunks = nil
+		b.err = ErrorBodyTooLarge
+	} else {
+		if len(c.GetBody()) > 0 {
+			b.chunks = append(b.chunks, append([]byte(nil), c.GetBody()...))
+		}
+		b.eof = c.GetEof()
+	}
+	b.cond.Broadcast()
+
+	return b.err
+}
+
+// CloseWithError ends the body early, for example when the connection is
+// lost. Pending reads return err.
+func (b *BodyReader) CloseWithError(err error) {
+	if err == nil {
+		err = io.ErrUnexpectedEOF
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err == nil && !b.eof {
+		b.err = err
+	}
+	b.cond.Broadcast()
+}
+
+func (b *BodyReader) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.chunks) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		if b.eof {
+			return 0, io.EOF
+		}
+		b.cond.Wait()
+	}
+
+	n := copy(p, b.chunks[0])
+	if n == len(b.chunks[0]) {
+		b.chunks[0] = nil
+		b.chunks = b.chunks[1:]
+	} else {
+		b.chunks[0] = b.chunks[0][n:]
+	}
+
+	return n, nil
+}
+
+// limitReader fails instead of truncating once more than n bytes are read.
+type limitReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, ErrorBodyTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n + int(l.n), ErrorBodyTooLarge
+	}
+
+	return n, err
+}
+
+type bodyReadCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (b *bodyReadCloser) Close() error {
+	closeAll(b.closers)
+	return nil
+}
+
+// Body wraps r, the raw request body, undoing its Content-Encoding and
+// transcoding text to UTF-8 according to the charset of its Content-Type.
+// Reading fails with ErrorBodyTooLarge past maxSize decoded bytes; zero
+// means DefaultMaxBodySize.
+func (x *HttpRequest) Body(r io.Reader, maxSize int64) (io.ReadCloser, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxBodySize
+	}
+	if x.GetContentLength() > maxSize && x.GetHeaderValue("Content-Encoding") == "" {
+		return nil, ErrorBodyTooLarge
+	}
+
+	r, closers, err := decodeContent(r, x.GetHeaderValue("Content-Encoding"))
+	if err != nil {
+		return nil, err
+	}
+	r = &limitReader{r: r, n: maxSize}
+
+	if m, err := x.MediaType(); err == nil && m.Charset() != "" {
+		d := getCharset(m.Charset())
+		if d == nil {
+			closeAll(closers)
+			return nil, ErrorUnsupportedCharset
+		}
+		r = d(r)
+	}
+
+	return &bodyReadCloser{Reader: r, closers: closers}, nil
+}
+
+// DecodeJSON decodes a JSON body into v, which may be a struct or a map.
+func (x *HttpRequest) DecodeJSON(r io.Reader, v any, maxSize int64) error {
+	body, err := x.Body(r, maxSize)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return json.NewDecoder(body).Decode(v)
+}
+
+// DecodeJSONMap decodes a JSON object body into a generic map.
+func (x *HttpRequest) DecodeJSONMap(r io.Reader, maxSize int64) (map[string]any, error) {
+	var m map[string]any
+	if err := x.DecodeJSON(r, &m, maxSize); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// DecodeXML decodes an XML body into v. A charset in the Content-Type takes
+// precedence over the one in the XML declaration.
+func (x *HttpRequest) DecodeXML(r io.Reader, v any, maxSize int64) error {
+	body, err := x.Body(r, maxSize)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	transcoded := false
+	if m, err := x.MediaType(); err == nil && m.Charset() != "" {
+		transcoded = true
+	}
+
+	d := xml.NewDecoder(body)
+	d.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		if transcoded {
+			return input, nil
+		}
+		c := getCharset(charset)
+		if c == nil {
+			return nil, ErrorUnsupportedCharset
+		}
+		return c(input), nil
+	}
+
+	return d.Decode(v)
+}
+
+// DecodeForm decodes an application/x-www-form-urlencoded body.
+func (x *HttpRequest) DecodeForm(r io.Reader, maxSize int64) (url.Values, error) {
+	text, err := x.DecodeText(r, maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return url.ParseQuery(text)
+}
+
+// DecodeText reads the whole body as UTF-8 text.
+func (x *HttpRequest) DecodeText(r io.Reader, maxSize int64) (string, error) {
+	body, err := x.Body(r, maxSize)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
@@ -0,0 +1,93 @@
+package commands_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"github.com/andybalholm/brotli"
+	"github.com/black40x/tunl-core/commands"
+	"io"
+	"strings"
+	"testing"
+)
+
+func encodeBody(t *testing.T, encoding, body string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		return []byte(body)
+	}
+	io.WriteString(w, body)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func bodyRequest(contentType, encoding string) *commands.HttpRequest {
+	req := &commands.HttpRequest{}
+	h := req.Headers()
+	h.Set("Content-Type", contentType)
+	if encoding != "" {
+		h.Set("Content-Encoding", encoding)
+	}
+	return req
+}
+
+func TestDecodeContentEncoding(t *testing.T) {
+	for _, enc := range []string{"", "gzip", "deflate", "br"} {
+		t.Run(enc, func(t *testing.T) {
+			req := bodyRequest("application/json", enc)
+			body := encodeBody(t, enc, `{"name":"tunl"}`)
+
+			m, err := req.DecodeJSONMap(bytes.NewReader(body), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if m["name"] != "tunl" {
+				t.Fatalf("decoded %v", m)
+			}
+		})
+	}
+}
+
+func TestDecodeUnsupportedEncoding(t *testing.T) {
+	req := bodyRequest("text/plain", "compress")
+	if _, err := req.DecodeText(strings.NewReader("x"), 0); err != commands.ErrorUnsupportedEncoding {
+		t.Fatalf("DecodeText() = %v", err)
+	}
+}
+
+func TestDecodeMaxSize(t *testing.T) {
+	body := strings.Repeat("a", 1000)
+	for _, enc := range []string{"", "gzip", "br"} {
+		t.Run(enc, func(t *testing.T) {
+			req := bodyRequest("text/plain", enc)
+			_, err := req.DecodeText(bytes.NewReader(encodeBody(t, enc, body)), 999)
+			if err != commands.ErrorBodyTooLarge {
+				t.Fatalf("DecodeText() = %v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeCharset(t *testing.T) {
+	req := bodyRequest("text/plain; charset=ISO-8859-1", "")
+	text, err := req.DecodeText(bytes.NewReader([]byte{'c', 'a', 'f', 0xe9}), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != "café" {
+		t.Fatalf("DecodeText() = %q", text)
+	}
+}
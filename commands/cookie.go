@@ -0,0 +1,147 @@
+package commands
+
+import (
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// CookieFromHTTP converts c. Expires is kept with second precision.
+func CookieFromHTTP(c *http.Cookie) *Cookie {
+	cookie := &Cookie{
+		Name:     c.Name,
+		Value:    c.Value,
+		Path:     c.Path,
+		Domain:   c.Domain,
+		MaxAge:   int32(c.MaxAge),
+		Secure:   c.Secure,
+		HttpOnly: c.HttpOnly,
+		SameSite: Cookie_SameSite(c.SameSite),
+	}
+	if !c.Expires.IsZero() {
+		cookie.Expires = c.Expires.Unix()
+	}
+
+	return cookie
+}
+
+func (x *Cookie) HTTP() *http.Cookie {
+	c := &http.Cookie{
+		Name:     x.GetName(),
+		Value:    x.GetValue(),
+		Path:     x.GetPath(),
+		Domain:   x.GetDomain(),
+		MaxAge:   int(x.GetMaxAge()),
+		Secure:   x.GetSecure(),
+		HttpOnly: x.GetHttpOnly(),
+		SameSite: http.SameSite(x.GetSameSite()),
+	}
+	if x.GetExpires() != 0 {
+		c.Expires = time.Unix(x.GetExpires(), 0).UTC()
+	}
+
+	return c
+}
+
+// Cookie returns the named request cookie or http.ErrNoCookie.
+func (x *HttpRequest) Cookie(name string) (*Cookie, error) {
+	for _, c := range x.GetCookies() {
+		if c.GetName() == name {
+			return c, nil
+		}
+	}
+
+	return nil, http.ErrNoCookie
+}
+
+func (x *HttpRequest) AddCookie(c *Cookie) {
+	x.Cookies = append(x.Cookies, c)
+}
+
+// HTTPCookies converts the request cookies for use with net/http.
+func (x *HttpRequest) HTTPCookies() []*http.Cookie {
+	cookies := make([]*http.Cookie, 0, len(x.GetCookies()))
+	for _, c := range x.GetCookies() {
+		cookies = append(cookies, c.HTTP())
+	}
+
+	return cookies
+}
+
+// SetCookie adds a Set-Cookie header. Invalid cookies are dropped, as
+// http.SetCookie does.
+func (x *HttpResponse) SetCookie(c *Cookie) {
+	if v := c.HTTP().String(); v != "" {
+		x.Headers().Add("Set-Cookie", v)
+	}
+}
+
+func parseSetCookie(v string) *http.Cookie {
+	cookies := (&http.Response{Header: http.Header{"Set-Cookie": {v}}}).Cookies()
+	if len(cookies) == 0 {
+		return nil
+	}
+	return cookies[0]
+}
+
+// Cookies parses the Set-Cookie headers of the response, skipping invalid
+// ones.
+func (x *HttpResponse) Cookies() []*Cookie {
+	var cookies []*Cookie
+	for _, v := range Headers(x.GetHeader()).Values("Set-Cookie") {
+		if c := parseSetCookie(v); c != nil {
+			cookies = append(cookies, CookieFromHTTP(c))
+		}
+	}
+
+	return cookies
+}
+
+// CookieRewriter adapts cookies set by the local service to the public
+// tunnel URL they are served under.
+type CookieRewriter struct {
+	// Domain replaces any Domain attribute, which names the local host and
+	// would be rejected by browsers; empty makes them host-only. Host-only
+	// cookies are left alone.
+	Domain string
+	// PathPrefix is prepended to Path when the tunnel is served under a
+	// path prefix.
+	PathPrefix string
+	// Secure marks every cookie Secure, for tunnels served over HTTPS.
+	Secure bool
+}
+
+func (r CookieRewriter) Rewrite(c *Cookie) {
+	if c.Domain != "" {
+		c.Domain = r.Domain
+	}
+	if r.PathPrefix != "" && c.Path != "" {
+		c.Path = path.Join("/", r.PathPrefix, c.Path)
+	}
+	// Browsers reject SameSite=None without Secure.
+	if r.Secure || c.SameSite == Cookie_NONE {
+		c.Secure = true
+	}
+}
+
+// RewriteCookies rewrites every Set-Cookie header of the response with r.
+// Headers that cannot be parsed are kept as they are.
+func (x *HttpResponse) RewriteCookies(r CookieRewriter) {
+	for _, h := range x.Header {
+		if !strings.EqualFold(h.GetKey(), "Set-Cookie") {
+			continue
+		}
+		for i, v := range h.Value {
+			hc := parseSetCookie(v)
+			if hc == nil {
+				continue
+			}
+			c := CookieFromHTTP(hc)
+			r.Rewrite(c)
+			if s := c.HTTP().String(); s != "" {
+				h.Value[i] = s
+			}
+		}
+	}
+}
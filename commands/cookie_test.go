@@ -0,0 +1,145 @@
+package commands_test
+
+import (
+	"github.com/black40x/tunl-core/commands"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCookieRewrite(t *testing.T) {
+	tests := []struct {
+		name string
+		r    commands.CookieRewriter
+		in   *commands.Cookie
+		want *commands.Cookie
+	}{
+		{"strip domain", commands.CookieRewriter{},
+			&commands.Cookie{Name: "a", Domain: "localhost"},
+			&commands.Cookie{Name: "a"}},
+		{"replace domain", commands.CookieRewriter{Domain: "x.tunl.dev"},
+			&commands.Cookie{Name: "a", Domain: "127.0.0.1"},
+			&commands.Cookie{Name: "a", Domain: "x.tunl.dev"}},
+		{"host-only stays host-only", commands.CookieRewriter{Domain: "x.tunl.dev"},
+			&commands.Cookie{Name: "a"},
+			&commands.Cookie{Name: "a"}},
+		{"mark secure", commands.CookieRewriter{Secure: true},
+			&commands.Cookie{Name: "a"},
+			&commands.Cookie{Name: "a", Secure: true}},
+		{"secure kept", commands.CookieRewriter{},
+			&commands.Cookie{Name: "a", Secure: true},
+			&commands.Cookie{Name: "a", Secure: true}},
+		{"samesite none needs secure", commands.CookieRewriter{},
+			&commands.Cookie{Name: "a", SameSite: commands.Cookie_NONE},
+			&commands.Cookie{Name: "a", SameSite: commands.Cookie_NONE, Secure: true}},
+		{"path under prefix", commands.CookieRewriter{PathPrefix: "/app"},
+			&commands.Cookie{Name: "a", Path: "/api"},
+			&commands.Cookie{Name: "a", Path: "/app/api"}},
+		{"root path under prefix", commands.CookieRewriter{PathPrefix: "/app/"},
+			&commands.Cookie{Name: "a", Path: "/"},
+			&commands.Cookie{Name: "a", Path: "/app"}},
+		{"relative prefix", commands.CookieRewriter{PathPrefix: "app"},
+			&commands.Cookie{Name: "a", Path: "/x/y/"},
+			&commands.Cookie{Name: "a", Path: "/app/x/y"}},
+		{"no path stays default", commands.CookieRewriter{PathPrefix: "/app"},
+			&commands.Cookie{Name: "a"},
+			&commands.Cookie{Name: "a"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.in
+			tt.r.Rewrite(c)
+			if c.Domain != tt.want.Domain || c.Path != tt.want.Path || c.Secure != tt.want.Secure || c.SameSite != tt.want.SameSite {
+				t.Fatalf("got %v, want %v", c, tt.want)
+			}
+		})
+	}
+}
+
+func TestRewriteCookies(t *testing.T) {
+	resp := &commands.HttpResponse{Header: []*commands.Header{
+		{Key: "set-cookie", Value: []string{
+			"sid=1; Domain=localhost; Path=/; HttpOnly",
+			"=broken",
+		}},
+		{Key: "Content-Type", Value: []string{"text/html"}},
+		{Key: "Set-Cookie", Value: []string{"theme=dark; Path=/ui; SameSite=None"}},
+	}}
+
+	resp.RewriteCookies(commands.CookieRewriter{PathPrefix: "/app"})
+
+	want := []*commands.Header{
+		{Key: "set-cookie", Value: []string{
+			"sid=1; Path=/app; HttpOnly",
+			"=broken",
+		}},
+		{Key: "Content-Type", Value: []string{"text/html"}},
+		{Key: "Set-Cookie", Value: []string{"theme=dark; Path=/app/ui; Secure; SameSite=None"}},
+	}
+	for i, h := range resp.Header {
+		if h.GetKey() != want[i].GetKey() || !reflect.DeepEqual(h.GetValue(), want[i].GetValue()) {
+			t.Errorf("header %d = %s: %q, want %s: %q", i, h.GetKey(), h.GetValue(), want[i].GetKey(), want[i].GetValue())
+		}
+	}
+}
+
+func TestCookieConversion(t *testing.T) {
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 600, time.UTC)
+	hc := &http.Cookie{
+		Name:     "sid",
+		Value:    "abc",
+		Path:     "/",
+		Domain:   "example.com",
+		Expires:  expires,
+		MaxAge:   60,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+
+	got := commands.CookieFromHTTP(hc).HTTP()
+	hc.Expires = expires.Truncate(time.Second)
+	if !reflect.DeepEqual(got, hc) {
+		t.Fatalf("round trip gave %+v, want %+v", got, hc)
+	}
+
+	if c := commands.CookieFromHTTP(&http.Cookie{Name: "a"}); c.GetExpires() != 0 || !c.HTTP().Expires.IsZero() {
+		t.Fatalf("zero expiry became %v", c.HTTP().Expires)
+	}
+}
+
+func TestResponseCookies(t *testing.T) {
+	resp := &commands.HttpResponse{}
+	resp.SetCookie(&commands.Cookie{Name: "a", Value: "1", Path: "/"})
+	resp.SetCookie(&commands.Cookie{Name: "bad name", Value: "2"})
+	resp.Headers().Add("set-cookie", "b=2; Max-Age=10")
+	resp.Headers().Add("Set-Cookie", "=invalid")
+
+	cookies := resp.Cookies()
+	if len(cookies) != 2 {
+		t.Fatalf("cookies: %v", cookies)
+	}
+	if c := cookies[0]; c.GetName() != "a" || c.GetValue() != "1" || c.GetPath() != "/" {
+		t.Fatalf("first cookie: %v", c)
+	}
+	if c := cookies[1]; c.GetName() != "b" || c.GetMaxAge() != 10 {
+		t.Fatalf("second cookie: %v", c)
+	}
+}
+
+func TestRequestCookies(t *testing.T) {
+	req := &commands.HttpRequest{}
+	req.AddCookie(&commands.Cookie{Name: "a", Value: "1"})
+	req.AddCookie(&commands.Cookie{Name: "b", Value: "2"})
+
+	if c, err := req.Cookie("b"); err != nil || c.GetValue() != "2" {
+		t.Fatalf("Cookie(b) = %v, %v", c, err)
+	}
+	if _, err := req.Cookie("c"); err != http.ErrNoCookie {
+		t.Fatalf("Cookie(c) error = %v", err)
+	}
+	if hc := req.HTTPCookies(); len(hc) != 2 || hc[0].Name != "a" || hc[1].Value != "2" {
+		t.Fatalf("HTTPCookies() = %v", hc)
+	}
+}
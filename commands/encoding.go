@@ -0,0 +1,152 @@
+package commands
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"github.com/andybalholm/brotli"
+	"io"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+var (
+	ErrorUnsupportedEncoding = errors.New("unsupported content encoding")
+	ErrorUnsupportedCharset  = errors.New("unsupported charset")
+)
+
+// ContentDecoder undoes one Content-Encoding.
+type ContentDecoder func(r io.Reader) (io.ReadCloser, error)
+
+// CharsetDecoder transcodes text in some charset to UTF-8.
+type CharsetDecoder func(r io.Reader) io.Reader
+
+var (
+	encodingsMu      sync.RWMutex
+	contentDecoders  = map[string]ContentDecoder{}
+	charsetDecoders  = map[string]CharsetDecoder{}
+	identityEncoding = func(r io.Reader) io.Reader { return r }
+)
+
+func init() {
+	gz := func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) }
+	RegisterContentDecoder("gzip", gz)
+	RegisterContentDecoder("x-gzip", gz)
+	RegisterContentDecoder("deflate", newDeflateReader)
+	RegisterContentDecoder("br", func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(brotli.NewReader(r)), nil
+	})
+
+	RegisterCharset("utf-8", identityEncoding)
+	RegisterCharset("utf8", identityEncoding)
+	RegisterCharset("us-ascii", identityEncoding)
+	RegisterCharset("iso-8859-1", newLatin1Reader)
+	RegisterCharset("latin1", newLatin1Reader)
+}
+
+// RegisterContentDecoder adds support for a Content-Encoding such as "zstd".
+func RegisterContentDecoder(name string, d ContentDecoder) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	contentDecoders[strings.ToLower(name)] = d
+}
+
+func RegisterCharset(name string, d CharsetDecoder) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+	charsetDecoders[strings.ToLower(name)] = d
+}
+
+func getContentDecoder(name string) ContentDecoder {
+	encodingsMu.RLock()
+	defer encodingsMu.RUnlock()
+	return contentDecoders[strings.ToLower(name)]
+}
+
+func getCharset(name string) CharsetDecoder {
+	encodingsMu.RLock()
+	defer encodingsMu.RUnlock()
+	return charsetDecoders[strings.ToLower(name)]
+}
+
+// decodeContent undoes the encodings listed in a Content-Encoding header,
+// last applied first.
+func decodeContent(r io.Reader, encoding string) (io.Reader, []io.Closer, error) {
+	var closers []io.Closer
+	codings := strings.Split(encoding, ",")
+	for i := len(codings) - 1; i >= 0; i-- {
+		name := strings.TrimSpace(codings[i])
+		if name == "" || strings.EqualFold(name, "identity") {
+			continue
+		}
+
+		d := getContentDecoder(name)
+		if d == nil {
+			closeAll(closers)
+			return nil, nil, ErrorUnsupportedEncoding
+		}
+		rc, err := d(r)
+		if err != nil {
+			closeAll(closers)
+			return nil, nil, err
+		}
+		closers = append(closers, rc)
+		r = rc
+	}
+
+	return r, closers, nil
+}
+
+func closeAll(closers []io.Closer) {
+	for i := len(closers) - 1; i >= 0; i-- {
+		closers[i].Close()
+	}
+}
+
+// newDeflateReader accepts both zlib-wrapped data, which is what the HTTP
+// deflate coding means, and the raw deflate streams some servers send.
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(2)
+	if err == nil && head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+		return zlib.NewReader(br)
+	}
+
+	return flate.NewReader(br), nil
+}
+
+type latin1Reader struct {
+	r       io.Reader
+	buf     []byte
+	out     []byte
+	pending []byte
+}
+
+func newLatin1Reader(r io.Reader) io.Reader {
+	return &latin1Reader{r: r}
+}
+
+func (l *latin1Reader) Read(p []byte) (int, error) {
+	if len(l.pending) == 0 {
+		if cap(l.buf) < len(p) {
+			l.buf = make([]byte, len(p))
+		}
+		n, err := l.r.Read(l.buf[:len(p)])
+		if n == 0 {
+			return 0, err
+		}
+		l.out = l.out[:0]
+		for _, b := range l.buf[:n] {
+			l.out = utf8.AppendRune(l.out, rune(b))
+		}
+		l.pending = l.out
+	}
+
+	n := copy(p, l.pending)
+	l.pending = l.pending[n:]
+
+	return n, nil
+}
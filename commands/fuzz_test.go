@@ -0,0 +1,73 @@
+package commands_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/black40x/tunl-core/commands"
+	"testing"
+)
+
+func authRequest(auth string) *commands.HttpRequest {
+	return &commands.HttpRequest{Header: []*commands.Header{
+		{Key: "Authorization", Value: []string{auth}},
+	}}
+}
+
+// FuzzBasicAuth checks that any credentials BasicAuth accepts encode back to
+// an equivalent header and pass CheckBasicAuth.
+func FuzzBasicAuth(f *testing.F) {
+	f.Add("")
+	f.Add("Basic")
+	f.Add("Basic ")
+	f.Add("Bearer abc")
+	f.Add("Basic " + base64.StdEncoding.EncodeToString([]byte("user:pass")))
+	f.Add("basic " + base64.StdEncoding.EncodeToString([]byte(":")))
+
+	f.Fuzz(func(t *testing.T, auth string) {
+		req := authRequest(auth)
+		user, pass, ok := req.BasicAuth()
+		if !ok {
+			return
+		}
+
+		again := authRequest("Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+pass)))
+		u, p, ok := again.BasicAuth()
+		if !ok || u != user || p != pass {
+			t.Fatalf("%q decoded to %q:%q, re-encoded to %q:%q", auth, user, pass, u, p)
+		}
+		if !req.CheckBasicAuth(user, pass) {
+			t.Fatalf("%q does not check against its own credentials", auth)
+		}
+	})
+}
+
+// FuzzFormData parses arbitrary multipart bodies under arbitrary
+// Content-Type headers.
+func FuzzFormData(f *testing.F) {
+	f.Add("multipart/form-data; boundary=xyz", []byte("--xyz\r\nContent-Disposition: form-data; name=\"a\"\r\n\r\n1\r\n--xyz--\r\n"))
+	f.Add("MULTIPART/FORM-DATA; boundary=\"a b\"", []byte("--a b--\r\n"))
+	f.Add("text/plain", []byte("x"))
+
+	f.Fuzz(func(t *testing.T, contentType string, body []byte) {
+		req := &commands.HttpRequest{Header: []*commands.Header{
+			{Key: "Content-Type", Value: []string{contentType}},
+		}}
+		boundary, ok := req.IsFormData()
+		if ok && boundary == "" {
+			t.Fatalf("%q reported an empty boundary", contentType)
+		}
+
+		form, err := req.ParseFormData(bytes.NewReader(body))
+		if err == nil {
+			form.RemoveAll()
+		}
+
+		limited, err := req.ParseFormDataLimits(bytes.NewReader(body), &commands.FormLimits{
+			MaxParts:  16,
+			MaxMemory: 1 << 16,
+		})
+		if err == nil {
+			limited.RemoveAll()
+		}
+	})
+}
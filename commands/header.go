@@ -0,0 +1,154 @@
+package commands
+
+import (
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// Headers gives http.Header semantics to the repeated Header field of a
+// request or response. Keys match case-insensitively and are stored in
+// canonical form when written; several entries with the same key are
+// treated as one.
+type Headers []*Header
+
+func (x *HttpRequest) Headers() *Headers {
+	return (*Headers)(&x.Header)
+}
+
+func (x *HttpResponse) Headers() *Headers {
+	return (*Headers)(&x.Header)
+}
+
+// HeadersFromHTTP converts h, ordering the keys for a stable encoding.
+func HeadersFromHTTP(h http.Header) Headers {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	hs := make(Headers, 0, len(keys))
+	for _, k := range keys {
+		hs = append(hs, &Header{
+			Key:   textproto.CanonicalMIMEHeaderKey(k),
+			Value: append([]string(nil), h[k]...),
+		})
+	}
+
+	return hs
+}
+
+// Get returns the first value of key, or "" if there is none.
+func (h Headers) Get(key string) string {
+	for _, e := range h {
+		if strings.EqualFold(e.GetKey(), key) && len(e.GetValue()) > 0 {
+			return e.GetValue()[0]
+		}
+	}
+
+	return ""
+}
+
+// Values returns every value of key.
+func (h Headers) Values(key string) []string {
+	var values []string
+	for _, e := range h {
+		if strings.EqualFold(e.GetKey(), key) {
+			values = append(values, e.GetValue()...)
+		}
+	}
+
+	return values
+}
+
+func (h Headers) Has(key string) bool {
+	for _, e := range h {
+		if strings.EqualFold(e.GetKey(), key) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Keys returns the distinct keys in canonical form, in order of appearance.
+func (h Headers) Keys() []string {
+	var keys []string
+	seen := map[string]bool{}
+	for _, e := range h {
+		k := textproto.CanonicalMIMEHeaderKey(e.GetKey())
+		if !seen[k] {
+			seen[k] = true
+			keys = append(keys, k)
+		}
+	}
+
+	return keys
+}
+
+// Set replaces all values of key with value, keeping the position of its
+// first entry.
+func (h *Headers) Set(key, value string) {
+	for i, e := range *h {
+		if strings.EqualFold(e.GetKey(), key) {
+			rest := (*h)[i+1:]
+			rest.Del(key)
+			*h = (*h)[:i+1+len(rest)]
+			(*h)[i] = &Header{Key: textproto.CanonicalMIMEHeaderKey(key), Value: []string{value}}
+			return
+		}
+	}
+	*h = append(*h, &Header{Key: textproto.CanonicalMIMEHeaderKey(key), Value: []string{value}})
+}
+
+// Add appends value to the values of key.
+func (h *Headers) Add(key, value string) {
+	for _, e := range *h {
+		if strings.EqualFold(e.GetKey(), key) {
+			e.Value = append(e.Value, value)
+			return
+		}
+	}
+	*h = append(*h, &Header{Key: textproto.CanonicalMIMEHeaderKey(key), Value: []string{value}})
+}
+
+func (h *Headers) Del(key string) {
+	out := (*h)[:0]
+	for _, e := range *h {
+		if !strings.EqualFold(e.GetKey(), key) {
+			out = append(out, e)
+		}
+	}
+	for i := len(out); i < len(*h); i++ {
+		(*h)[i] = nil
+	}
+	*h = out
+}
+
+// Clone returns a deep copy that can be changed independently.
+func (h Headers) Clone() Headers {
+	if h == nil {
+		return nil
+	}
+
+	c := make(Headers, len(h))
+	for i, e := range h {
+		c[i] = &Header{Key: e.GetKey(), Value: append([]string(nil), e.GetValue()...)}
+	}
+
+	return c
+}
+
+// HTTP converts the headers to an http.Header, merging entries that differ
+// only in case.
+func (h Headers) HTTP() http.Header {
+	hh := make(http.Header, len(h))
+	for _, e := range h {
+		k := textproto.CanonicalMIMEHeaderKey(e.GetKey())
+		hh[k] = append(hh[k], e.GetValue()...)
+	}
+
+	return hh
+}
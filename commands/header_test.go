@@ -0,0 +1,165 @@
+package commands_test
+
+import (
+	"github.com/black40x/tunl-core/commands"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// dump renders h as "Key=v1,v2|Key=v" so whole header lists compare easily.
+func dump(h commands.Headers) string {
+	var parts []string
+	for _, e := range h {
+		parts = append(parts, e.GetKey()+"="+strings.Join(e.GetValue(), ","))
+	}
+	return strings.Join(parts, "|")
+}
+
+// rawHeaders builds entries as they may arrive on the wire, in any case and
+// with repeated keys.
+func rawHeaders() commands.Headers {
+	return commands.Headers{
+		{Key: "content-type", Value: []string{"text/plain"}},
+		{Key: "X-Trace", Value: []string{"a", "b"}},
+		{Key: "Accept", Value: []string{"*/*"}},
+		{Key: "x-trace", Value: []string{"c"}},
+	}
+}
+
+func TestHeadersChange(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(h *commands.Headers)
+		want   string
+	}{
+		{"set new", func(h *commands.Headers) { h.Set("x-new", "1") },
+			"content-type=text/plain|X-Trace=a,b|Accept=*/*|x-trace=c|X-New=1"},
+		{"set replaces all entries in place", func(h *commands.Headers) { h.Set("X-TRACE", "z") },
+			"content-type=text/plain|X-Trace=z|Accept=*/*"},
+		{"set canonicalizes", func(h *commands.Headers) { h.Set("CONTENT-TYPE", "text/html") },
+			"Content-Type=text/html|X-Trace=a,b|Accept=*/*|x-trace=c"},
+		{"add to existing", func(h *commands.Headers) { h.Add("accept", "text/html") },
+			"content-type=text/plain|X-Trace=a,b|Accept=*/*,text/html|x-trace=c"},
+		{"add to first of repeated", func(h *commands.Headers) { h.Add("x-trace", "d") },
+			"content-type=text/plain|X-Trace=a,b,d|Accept=*/*|x-trace=c"},
+		{"add new", func(h *commands.Headers) { h.Add("via", "tunl") },
+			"content-type=text/plain|X-Trace=a,b|Accept=*/*|x-trace=c|Via=tunl"},
+		{"del every entry and value", func(h *commands.Headers) { h.Del("X-Trace") },
+			"content-type=text/plain|Accept=*/*"},
+		{"del missing", func(h *commands.Headers) { h.Del("Cookie") },
+			"content-type=text/plain|X-Trace=a,b|Accept=*/*|x-trace=c"},
+		{"del all", func(h *commands.Headers) {
+			for _, k := range h.Keys() {
+				h.Del(k)
+			}
+		}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := rawHeaders()
+			tt.change(&h)
+			if got := dump(h); got != tt.want {
+				t.Fatalf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeadersRead(t *testing.T) {
+	h := rawHeaders()
+
+	tests := []struct {
+		key    string
+		get    string
+		values []string
+		has    bool
+	}{
+		{"Content-Type", "text/plain", []string{"text/plain"}, true},
+		{"CONTENT-TYPE", "text/plain", []string{"text/plain"}, true},
+		{"x-trace", "a", []string{"a", "b", "c"}, true},
+		{"Cookie", "", nil, false},
+	}
+	for _, tt := range tests {
+		if got := h.Get(tt.key); got != tt.get {
+			t.Errorf("Get(%q) = %q, want %q", tt.key, got, tt.get)
+		}
+		if got := h.Values(tt.key); !reflect.DeepEqual(got, tt.values) {
+			t.Errorf("Values(%q) = %q, want %q", tt.key, got, tt.values)
+		}
+		if got := h.Has(tt.key); got != tt.has {
+			t.Errorf("Has(%q) = %v, want %v", tt.key, got, tt.has)
+		}
+	}
+
+	if got, want := h.Keys(), []string{"Content-Type", "X-Trace", "Accept"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys() = %q, want %q", got, want)
+	}
+
+	empty := commands.Headers{{Key: "X-Empty"}}
+	if !empty.Has("x-empty") || empty.Get("x-empty") != "" {
+		t.Error("key without values")
+	}
+}
+
+func TestHeadersClone(t *testing.T) {
+	h := rawHeaders()
+	c := h.Clone()
+
+	c.Set("Accept", "text/html")
+	c[0].Value[0] = "changed"
+	c.Add("X-Trace", "d")
+
+	if got, want := dump(h), dump(rawHeaders()); got != want {
+		t.Fatalf("original changed through the clone: %s", got)
+	}
+	if commands.Headers(nil).Clone() != nil {
+		t.Fatal("clone of nil headers is not nil")
+	}
+}
+
+func TestHeadersHTTP(t *testing.T) {
+	got := rawHeaders().HTTP()
+	want := http.Header{
+		"Content-Type": {"text/plain"},
+		"X-Trace":      {"a", "b", "c"},
+		"Accept":       {"*/*"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("HTTP() = %v, want %v", got, want)
+	}
+
+	h := commands.HeadersFromHTTP(http.Header{
+		"x-lower": {"1"},
+		"Accept":  {"a", "b"},
+		"Via":     {"tunl"},
+	})
+	if got, want := dump(h), "Accept=a,b|Via=tunl|X-Lower=1"; got != want {
+		t.Fatalf("HeadersFromHTTP = %s, want %s", got, want)
+	}
+
+	src := http.Header{"Accept": {"a"}}
+	h = commands.HeadersFromHTTP(src)
+	src["Accept"][0] = "changed"
+	if h.Get("Accept") != "a" {
+		t.Fatal("HeadersFromHTTP shares values with its input")
+	}
+}
+
+func TestRequestHeaders(t *testing.T) {
+	req := &commands.HttpRequest{}
+	req.Headers().Set("host", "example.com")
+	req.Headers().Add("Accept", "*/*")
+
+	if req.GetHeaderValue("Host") != "example.com" || len(req.GetHeader()) != 2 {
+		t.Fatalf("request headers: %v", req.GetHeader())
+	}
+
+	resp := &commands.HttpResponse{}
+	resp.Headers().Add("set-cookie", "a=1")
+	resp.Headers().Add("Set-Cookie", "b=2")
+	if got := resp.Headers().Values("Set-Cookie"); !reflect.DeepEqual(got, []string{"a=1", "b=2"}) {
+		t.Fatalf("response headers: %v", resp.GetHeader())
+	}
+}
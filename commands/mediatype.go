@@ -0,0 +1,170 @@
+package commands
+
+import (
+	"errors"
+	"mime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var ErrorMediaType = errors.New("invalid media type")
+
+// MediaType is a parsed Content-Type or Accept entry. For
+// "application/vnd.api+json; charset=utf-8" Type is "application", Subtype
+// "vnd.api+json", Suffix "json" and Params holds the charset.
+type MediaType struct {
+	Type    string
+	Subtype string
+	Suffix  string
+	Params  map[string]string
+}
+
+func ParseMediaType(v string) (MediaType, error) {
+	mt, params, err := mime.ParseMediaType(v)
+	if err != nil {
+		return MediaType{}, err
+	}
+
+	typ, sub, ok := strings.Cut(mt, "/")
+	if !ok || typ == "" || sub == "" {
+		return MediaType{}, ErrorMediaType
+	}
+	m := MediaType{Type: typ, Subtype: sub, Params: params}
+	if i := strings.LastIndexByte(sub, '+'); i >= 0 {
+		m.Suffix = sub[i+1:]
+	}
+
+	return m, nil
+}
+
+// String returns type/subtype without parameters.
+func (m MediaType) String() string {
+	return m.Type + "/" + m.Subtype
+}
+
+func (m MediaType) Charset() string {
+	return m.Params["charset"]
+}
+
+// Is reports whether m is t, given as "type/subtype". A suffix matches its
+// base type, so "application/vnd.api+json" is "application/json".
+func (m MediaType) Is(t string) bool {
+	typ, sub, _ := strings.Cut(t, "/")
+	if m.Type != typ {
+		return false
+	}
+	return m.Subtype == sub || m.Suffix == sub
+}
+
+// Matches reports whether the range m, as found in an Accept header, covers
+// the media type t. Wildcards are allowed in m only.
+func (m MediaType) Matches(t string) bool {
+	typ, sub, _ := strings.Cut(t, "/")
+	switch {
+	case m.Type == "*":
+		return true
+	case m.Type != typ:
+		return false
+	}
+	return m.Subtype == "*" || m.Subtype == sub
+}
+
+func (m MediaType) specificity() int {
+	switch {
+	case m.Type == "*":
+		return 0
+	case m.Subtype == "*":
+		return 1
+	}
+	return 2
+}
+
+// AcceptRange is one entry of an Accept header with its quality.
+type AcceptRange struct {
+	MediaType
+	Q float64
+}
+
+// ParseAccept parses an Accept header, most preferred ranges first.
+// Malformed entries are skipped.
+func ParseAccept(v string) []AcceptRange {
+	var ranges []AcceptRange
+	for _, part := range strings.Split(v, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		m, err := ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if s, ok := m.Params["q"]; ok {
+			q, err = strconv.ParseFloat(s, 64)
+			if err != nil || q < 0 || q > 1 {
+				continue
+			}
+			delete(m.Params, "q")
+		}
+		ranges = append(ranges, AcceptRange{MediaType: m, Q: q})
+	}
+
+	sort.SliceStable(ranges, func(i, j int) bool {
+		return ranges[i].Q > ranges[j].Q
+	})
+
+	return ranges
+}
+
+// quality returns the quality the most specific matching range gives t.
+func quality(ranges []AcceptRange, t string) float64 {
+	q, best := 0.0, -1
+	for _, r := range ranges {
+		if s := r.specificity(); s > best && r.Matches(t) {
+			q, best = r.Q, s
+		}
+	}
+	return q
+}
+
+// Negotiate picks the offer the Accept header prefers, keeping the order of
+// offers on ties. Without an Accept header the first offer wins; if none is
+// acceptable it returns "".
+func Negotiate(accept string, offers ...string) string {
+	if strings.TrimSpace(accept) == "" {
+		if len(offers) == 0 {
+			return ""
+		}
+		return offers[0]
+	}
+
+	ranges := ParseAccept(accept)
+	best, bestQ := "", 0.0
+	for _, o := range offers {
+		if q := quality(ranges, o); q > bestQ {
+			best, bestQ = o, q
+		}
+	}
+
+	return best
+}
+
+func (x *HttpRequest) MediaType() (MediaType, error) {
+	return ParseMediaType(x.GetContentType())
+}
+
+func (x *HttpResponse) MediaType() (MediaType, error) {
+	return ParseMediaType(x.GetContentType())
+}
+
+// Accepts reports whether the Accept header allows the media type t.
+func (x *HttpRequest) Accepts(t string) bool {
+	accept := x.GetHeaderValue("Accept")
+	return strings.TrimSpace(accept) == "" || quality(ParseAccept(accept), t) > 0
+}
+
+// Negotiate picks the response format the request prefers among offers.
+func (x *HttpRequest) Negotiate(offers ...string) string {
+	return Negotiate(x.GetHeaderValue("Accept"), offers...)
+}
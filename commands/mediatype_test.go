@@ -0,0 +1,145 @@
+package commands_test
+
+import (
+	"github.com/black40x/tunl-core/commands"
+	"testing"
+)
+
+func TestParseMediaType(t *testing.T) {
+	tests := []struct {
+		in      string
+		typ     string
+		subtype string
+		suffix  string
+		charset string
+		err     bool
+	}{
+		{"text/html", "text", "html", "", "", false},
+		{"Text/HTML; Charset=UTF-8", "text", "html", "", "UTF-8", false},
+		{"application/vnd.api+json; charset=utf-8", "application", "vnd.api+json", "json", "utf-8", false},
+		{"application/a+b+xml", "application", "a+b+xml", "xml", "", false},
+		{`text/plain; charset="us-ascii"`, "text", "plain", "", "us-ascii", false},
+		{"", "", "", "", "", true},
+		{"text", "", "", "", "", true},
+		{"text/", "", "", "", "", true},
+		{"/html", "", "", "", "", true},
+		{"text/html; charset", "", "", "", "", true},
+	}
+	for _, tt := range tests {
+		m, err := commands.ParseMediaType(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("ParseMediaType(%q) error = %v, want error %v", tt.in, err, tt.err)
+			continue
+		}
+		if m.Type != tt.typ || m.Subtype != tt.subtype || m.Suffix != tt.suffix || m.Charset() != tt.charset {
+			t.Errorf("ParseMediaType(%q) = %+v", tt.in, m)
+		}
+	}
+}
+
+func TestMediaTypeIs(t *testing.T) {
+	m, err := commands.ParseMediaType("application/vnd.api+json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for t2, want := range map[string]bool{
+		"application/vnd.api+json": true,
+		"application/json":         true,
+		"application/xml":          false,
+		"text/json":                false,
+	} {
+		if got := m.Is(t2); got != want {
+			t.Errorf("Is(%q) = %v, want %v", t2, got, want)
+		}
+	}
+}
+
+func TestParseAccept(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		q    []float64
+	}{
+		{"", nil, nil},
+		{"text/html", []string{"text/html"}, []float64{1}},
+		{"text/*;q=0.5, application/json, */*;q=0.1", []string{"application/json", "text/*", "*/*"}, []float64{1, 0.5, 0.1}},
+		// Ties keep the order of the header.
+		{"b/b;q=0.5, a/a;q=0.5, c/c", []string{"c/c", "b/b", "a/a"}, []float64{1, 0.5, 0.5}},
+		{"text/html;q=0", []string{"text/html"}, []float64{0}},
+		// Malformed entries are skipped, the rest is kept.
+		{"text/html;q=abc, application/json", []string{"application/json"}, []float64{1}},
+		{"text/html;q=1.5, text/plain;q=-1, */*", []string{"*/*"}, []float64{1}},
+		{"garbage, , text/plain", []string{"text/plain"}, []float64{1}},
+	}
+	for _, tt := range tests {
+		ranges := commands.ParseAccept(tt.in)
+		if len(ranges) != len(tt.want) {
+			t.Errorf("ParseAccept(%q) = %v, want %v", tt.in, ranges, tt.want)
+			continue
+		}
+		for i, r := range ranges {
+			if r.String() != tt.want[i] || r.Q != tt.q[i] {
+				t.Errorf("ParseAccept(%q)[%d] = %s;q=%v, want %s;q=%v", tt.in, i, r, r.Q, tt.want[i], tt.q[i])
+			}
+		}
+	}
+}
+
+func TestParseAcceptParams(t *testing.T) {
+	ranges := commands.ParseAccept("text/html;level=1;q=0.7")
+	if len(ranges) != 1 {
+		t.Fatalf("ranges: %v", ranges)
+	}
+	if p := ranges[0].Params; p["level"] != "1" || len(p) != 1 {
+		t.Fatalf("params %v, want level only", p)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		offers []string
+		want   string
+	}{
+		{"no header", "", []string{"application/json", "text/html"}, "application/json"},
+		{"no header no offers", "  ", nil, ""},
+		{"exact", "text/html", []string{"application/json", "text/html"}, "text/html"},
+		{"quality", "text/html;q=0.8, application/json", []string{"text/html", "application/json"}, "application/json"},
+		{"tie keeps offer order", "*/*", []string{"application/json", "text/html"}, "application/json"},
+		{"q=0 excludes", "text/html;q=0, */*", []string{"text/html"}, ""},
+		{"q=0 excludes one offer", "text/html;q=0, */*", []string{"text/html", "application/json"}, "application/json"},
+		{"specific beats wildcard", "*/*;q=0.9, text/*;q=0.2, text/html;q=0.5", []string{"text/plain", "text/html", "image/png"}, "image/png"},
+		{"subtype wildcard beats any", "text/*;q=0.1, */*;q=1", []string{"text/plain", "image/png"}, "image/png"},
+		{"specific range wins over broad q", "text/*, text/plain;q=0.1", []string{"text/plain", "text/html"}, "text/html"},
+		{"none acceptable", "image/png", []string{"text/html", "application/json"}, ""},
+		{"malformed q ignored", "text/html;q=x, application/json;q=0.5", []string{"text/html", "application/json"}, "application/json"},
+		{"parameters ignored for matching", "text/html;level=1", []string{"text/html"}, "text/html"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := commands.Negotiate(tt.accept, tt.offers...); got != tt.want {
+				t.Fatalf("Negotiate(%q, %q) = %q, want %q", tt.accept, tt.offers, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestAccepts(t *testing.T) {
+	req := &commands.HttpRequest{}
+	if !req.Accepts("text/html") {
+		t.Fatal("request without Accept refuses text/html")
+	}
+
+	req.Headers().Set("Accept", "application/*, text/html;q=0")
+	for typ, want := range map[string]bool{
+		"application/json": true,
+		"text/html":        false,
+		"image/png":        false,
+	} {
+		if got := req.Accepts(typ); got != want {
+			t.Errorf("Accepts(%q) = %v, want %v", typ, got, want)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package commands
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"strings"
+)
+
+// ParseFormData keeps up to DefaultFormMemory of a form in memory and
+// spills larger files to disk, up to DefaultFormMaxSize for the whole body.
+const (
+	DefaultFormMemory   = 8 << 20
+	DefaultFormMaxSize  = 128 << 20
+	DefaultFormMaxParts = 1000
+)
+
+var (
+	ErrorTooManyParts = errors.New("too many form parts")
+	ErrorPartTooLarge = errors.New("form part too large")
+	ErrorFormTooLarge = errors.New("form too large")
+)
+
+// validBoundary checks a multipart boundary against RFC 2046: 1 to 70
+// characters from a restricted set, not ending in a space.
+func validBoundary(b string) bool {
+	if len(b) == 0 || len(b) > 70 || b[len(b)-1] == ' ' {
+		return false
+	}
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case strings.IndexByte("'()+_,-./:=? ", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// FormLimits bounds the resources a multipart body may use. Zero values
+// pick the defaults noted on each field.
+type FormLimits struct {
+	// MaxParts caps the number of parts, DefaultFormMaxParts by default.
+	MaxParts int
+	// MaxPartSize caps the size of any single part. Zero means no cap
+	// beyond the memory and disk limits.
+	MaxPartSize int64
+	// MaxMemory is the total size of the parts kept in memory,
+	// DefaultFormMemory by default.
+	MaxMemory int64
+	// MaxDiskSize is the total size of file parts that may spill to
+	// temporary files once memory is used up. Zero disables spilling.
+	MaxDiskSize int64
+	// TempDir holds the spilled files, os.TempDir by default.
+	TempDir string
+}
+
+func (l *FormLimits) withDefaults() FormLimits {
+	var c FormLimits
+	if l != nil {
+		c = *l
+	}
+	if c.MaxParts <= 0 {
+		c.MaxParts = DefaultFormMaxParts
+	}
+	if c.MaxMemory <= 0 {
+		c.MaxMemory = DefaultFormMemory
+	}
+
+	return c
+}
+
+// FormPart is one part of a multipart body. Reading it fails with
+// ErrorPartTooLarge past FormLimits.MaxPartSize.
+type FormPart struct {
+	*multipart.Part
+	r io.Reader
+}
+
+func (p *FormPart) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if err == ErrorBodyTooLarge {
+		err = ErrorPartTooLarge
+	}
+	return n, err
+}
+
+// WalkFormData streams a multipart body, calling fn for each part in turn.
+// Whatever fn leaves unread of a part is skipped. Walking stops at the first
+// error, including one returned by fn.
+func (x *HttpRequest) WalkFormData(r io.Reader, limits *FormLimits, fn func(p *FormPart) error) error {
+	boundary, ok := x.IsFormData()
+	if !ok {
+		return ErrorFormData
+	}
+	l := limits.withDefaults()
+
+	mr := multipart.NewReader(r, boundary)
+	for n := 0; ; n++ {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n >= l.MaxParts {
+			part.Close()
+			return ErrorTooManyParts
+		}
+
+		fp := &FormPart{Part: part, r: part}
+		if l.MaxPartSize > 0 {
+			fp.r = &limitReader{r: part, n: l.MaxPartSize}
+		}
+		err = fn(fp)
+		part.Close()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// FormFile is an uploaded file held in memory or in a temporary file.
+type FormFile struct {
+	Filename string
+	Header   textproto.MIMEHeader
+	Size     int64
+	content  []byte
+	tmpfile  string
+}
+
+type sectionReadCloser struct {
+	*io.SectionReader
+}
+
+func (sectionReadCloser) Close() error {
+	return nil
+}
+
+func (f *FormFile) Open() (multipart.File, error) {
+	if f.tmpfile != "" {
+		return os.Open(f.tmpfile)
+	}
+	r := io.NewSectionReader(bytes.NewReader(f.content), 0, int64(len(f.content)))
+	return sectionReadCloser{r}, nil
+}
+
+type Form struct {
+	Value map[string][]string
+	File  map[string][]*FormFile
+}
+
+// RemoveAll deletes the temporary files of the form.
+func (f *Form) RemoveAll() error {
+	var err error
+	for _, files := range f.File {
+		for _, file := range files {
+			if file.tmpfile == "" {
+				continue
+			}
+			if e := os.Remove(file.tmpfile); e != nil && !errors.Is(e, os.ErrNotExist) && err == nil {
+				err = e
+			}
+		}
+	}
+
+	return err
+}
+
+// ParseFormDataLimits reads a whole multipart body within limits. Values and
+// small files stay in memory; file parts that do not fit spill to disk when
+// FormLimits.MaxDiskSize allows it. On error no temporary files are left
+// behind.
+func (x *HttpRequest) ParseFormDataLimits(r io.Reader, limits *FormLimits) (form *Form, err error) {
+	l := limits.withDefaults()
+	form = &Form{Value: map[string][]string{}, File: map[string][]*FormFile{}}
+	defer func() {
+		if err != nil {
+			form.RemoveAll()
+			form = nil
+		}
+	}()
+
+	memory, disk := l.MaxMemory, l.MaxDiskSize
+	err = x.WalkFormData(r, &l, func(p *FormPart) error {
+		name := p.FormName()
+		if name == "" {
+			return nil
+		}
+
+		var buf bytes.Buffer
+		n, err := io.Copy(&buf, io.LimitReader(p, memory+1))
+		if err != nil {
+			return err
+		}
+
+		if p.FileName() == "" {
+			if n > memory {
+				return ErrorFormTooLarge
+			}
+			memory -= n
+			form.Value[name] = append(form.Value[name], buf.String())
+			return nil
+		}
+
+		file := &FormFile{Filename: p.FileName(), Header: p.Header}
+		if n <= memory {
+			memory -= n
+			file.content, file.Size = buf.Bytes(), n
+		} else {
+			size, err := spill(p, &buf, disk, l.TempDir, file)
+			if err != nil {
+				return err
+			}
+			disk -= size
+			file.Size = size
+		}
+		form.File[name] = append(form.File[name], file)
+
+		return nil
+	})
+
+	return form, err
+}
+
+// spill writes the buffered head of a part and the rest of it to a temporary
+// file, using at most limit bytes of disk.
+func spill(p io.Reader, head *bytes.Buffer, limit int64, dir string, file *FormFile) (int64, error) {
+	if int64(head.Len()) > limit {
+		return 0, ErrorFormTooLarge
+	}
+
+	f, err := os.CreateTemp(dir, "tunl-multipart-")
+	if err != nil {
+		return 0, err
+	}
+	file.tmpfile = f.Name()
+
+	size, err := io.Copy(f, io.MultiReader(head, &limitReader{r: p, n: limit - int64(head.Len())}))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == ErrorBodyTooLarge {
+		err = ErrorFormTooLarge
+	}
+	if err != nil {
+		os.Remove(file.tmpfile)
+		file.tmpfile = ""
+		return 0, err
+	}
+
+	return size, nil
+}
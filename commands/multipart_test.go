@@ -0,0 +1,95 @@
+package commands_test
+
+import (
+	"bytes"
+	"github.com/black40x/tunl-core/commands"
+	"io"
+	"mime/multipart"
+	"os"
+	"strings"
+	"testing"
+)
+
+type repeatReader byte
+
+func (r repeatReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = byte(r)
+	}
+	return len(p), nil
+}
+
+// formBody returns a multipart body with one value and one file of size
+// bytes.
+func formBody(t *testing.T, size int64) (*commands.HttpRequest, io.Reader) {
+	t.Helper()
+
+	var head bytes.Buffer
+	w := multipart.NewWriter(&head)
+	w.WriteField("name", "tunl")
+	if _, err := w.CreateFormFile("upload", "data.bin"); err != nil {
+		t.Fatal(err)
+	}
+	tail := "\r\n--" + w.Boundary() + "--\r\n"
+
+	req := &commands.HttpRequest{}
+	req.Headers().Set("Content-Type", w.FormDataContentType())
+
+	return req, io.MultiReader(&head, io.LimitReader(repeatReader('x'), size), strings.NewReader(tail))
+}
+
+func TestParseFormDataSpills(t *testing.T) {
+	req, body := formBody(t, commands.DefaultFormMemory+1)
+
+	form, err := req.ParseFormData(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer form.RemoveAll()
+
+	if got := form.Value["name"]; len(got) != 1 || got[0] != "tunl" {
+		t.Fatalf("name = %v", got)
+	}
+	fh := form.File["upload"][0]
+	if fh.Size != commands.DefaultFormMemory+1 {
+		t.Fatalf("file size %d", fh.Size)
+	}
+	f, err := fh.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, ok := f.(*os.File); !ok {
+		t.Fatalf("large upload kept in memory as %T", f)
+	}
+}
+
+func TestParseFormDataTooLarge(t *testing.T) {
+	req, body := formBody(t, commands.DefaultFormMaxSize)
+
+	if _, err := req.ParseFormData(body); err != commands.ErrorFormTooLarge {
+		t.Fatalf("ParseFormData() = %v", err)
+	}
+}
+
+func TestParseFormDataLimits(t *testing.T) {
+	req, body := formBody(t, 1<<10)
+	if _, err := req.ParseFormDataLimits(body, &commands.FormLimits{MaxMemory: 1 << 9}); err != commands.ErrorFormTooLarge {
+		t.Fatalf("without disk: %v", err)
+	}
+
+	req, body = formBody(t, 1<<10)
+	form, err := req.ParseFormDataLimits(body, &commands.FormLimits{MaxMemory: 1 << 9, MaxDiskSize: 1 << 11, TempDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer form.RemoveAll()
+	if f := form.File["upload"][0]; f.Size != 1<<10 {
+		t.Fatalf("file size %d", f.Size)
+	}
+
+	req, body = formBody(t, 1<<10)
+	if _, err = req.ParseFormDataLimits(body, &commands.FormLimits{MaxParts: 1}); err != commands.ErrorTooManyParts {
+		t.Fatalf("too many parts: %v", err)
+	}
+}
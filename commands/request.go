@@ -13,21 +13,13 @@ import (
 var ErrorFormData = errors.New("invalid form data")
 
 func (x *HttpRequest) GetHeaderValue(k string) string {
-	for _, key := range x.Header {
-		if strings.ToLower(key.GetKey()) == strings.ToLower(k) {
-			if len(key.GetValue()) > 0 {
-				return key.GetValue()[0]
-			}
-		}
-	}
-
-	return ""
+	return Headers(x.GetHeader()).Get(k)
 }
 
 func (x *HttpRequest) BasicAuth() (username, password string, ok bool) {
 	const prefix = "Basic "
 	auth := x.GetHeaderValue("Authorization")
-	if auth == "" {
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
 		return "", "", false
 	}
 
@@ -67,44 +59,65 @@ func (x *HttpRequest) GetContentType() string {
 	return x.GetHeaderValue("Content-Type")
 }
 
+func (x *HttpRequest) isMediaType(types ...string) bool {
+	m, err := x.MediaType()
+	if err != nil {
+		return false
+	}
+	for _, t := range types {
+		if m.Is(t) {
+			return true
+		}
+	}
+	return false
+}
+
 func (x *HttpRequest) IsJson() bool {
-	return x.GetHeaderValue("Content-Type") == "application/json"
+	return x.isMediaType("application/json")
 }
 
 func (x *HttpRequest) IsTextPlain() bool {
-	return x.GetHeaderValue("Content-Type") == "text/plain"
+	return x.isMediaType("text/plain")
 }
 
 func (x *HttpRequest) IsXML() bool {
-	return x.GetHeaderValue("Content-Type") == "application/xml"
+	return x.isMediaType("application/xml", "text/xml")
 }
 
 func (x *HttpRequest) IsFormUrlencoded() bool {
-	return x.GetHeaderValue("Content-Type") == "application/x-www-form-urlencoded"
+	return x.isMediaType("application/x-www-form-urlencoded")
 }
 
 func (x *HttpRequest) IsFormData() (boundary string, ok bool) {
-	const formDataPrefix = "multipart/form-data"
-
-	header := x.GetHeaderValue("Content-Type")
-	contType, boundary, ok := strings.Cut(header, ";")
-	if ok && strings.ToLower(contType) == formDataPrefix {
-		_, boundary, ok = strings.Cut(boundary, "=")
-		if ok {
-			return boundary, ok
-		}
+	m, err := x.MediaType()
+	if err != nil || !m.Is("multipart/form-data") {
+		return "", false
 	}
-	return "", false
+
+	boundary = m.Params["boundary"]
+	if !validBoundary(boundary) {
+		return "", false
+	}
+	return boundary, true
 }
 
+// ParseFormData reads a whole multipart body. Files that do not fit in
+// DefaultFormMemory are stored in temporary files, and bodies larger than
+// DefaultFormMaxSize fail with ErrorFormTooLarge. ParseFormDataLimits and
+// WalkFormData give finer control.
 func (x *HttpRequest) ParseFormData(r io.Reader) (*multipart.Form, error) {
 	boundary, ok := x.IsFormData()
 	if !ok {
 		return nil, ErrorFormData
 	}
 
-	reader := multipart.NewReader(r, boundary)
-	return reader.ReadForm(0)
+	reader := multipart.NewReader(&limitReader{r: r, n: DefaultFormMaxSize}, boundary)
+	form, err := reader.ReadForm(DefaultFormMemory)
+	if errors.Is(err, ErrorBodyTooLarge) {
+		return nil, ErrorFormTooLarge
+	}
+
+	return form, err
 }
 
 func (x *HttpRequest) IsBrowserRequest() bool {
@@ -0,0 +1,9 @@
+package commands
+
+func (x *HttpResponse) GetHeaderValue(k string) string {
+	return Headers(x.GetHeader()).Get(k)
+}
+
+func (x *HttpResponse) GetContentType() string {
+	return x.GetHeaderValue("Content-Type")
+}
@@ -0,0 +1,62 @@
+package commands
+
+import "google.golang.org/protobuf/proto"
+
+func NewTransfer(m proto.Message) *Transfer {
+	trans := &Transfer{}
+	switch m.(type) {
+	case *ServerHeader:
+		trans.Command = &Transfer_ServerHeader{
+			ServerHeader: m.(*ServerHeader),
+		}
+	case *ServerConnect:
+		trans.Command = &Transfer_ServerConnect{
+			ServerConnect: m.(*ServerConnect),
+		}
+	case *ClientConnect:
+		trans.Command = &Transfer_ClientConnect{
+			ClientConnect: m.(*ClientConnect),
+		}
+	case *HttpRequest:
+		trans.Command = &Transfer_HttpRequest{
+			HttpRequest: m.(*HttpRequest),
+		}
+	case *HttpResponse:
+		trans.Command = &Transfer_HttpResponse{
+			HttpResponse: m.(*HttpResponse),
+		}
+	case *BodyChunk:
+		trans.Command = &Transfer_BodyChunk{
+			BodyChunk: m.(*BodyChunk),
+		}
+	case *Error:
+		trans.Command = &Transfer_Error{
+			Error: m.(*Error),
+		}
+	}
+
+	return trans
+}
+
+// Message returns the command carried by the transfer, or nil if it is
+// empty.
+func (x *Transfer) Message() proto.Message {
+	switch c := x.GetCommand().(type) {
+	case *Transfer_ServerHeader:
+		return c.ServerHeader
+	case *Transfer_ServerConnect:
+		return c.ServerConnect
+	case *Transfer_ClientConnect:
+		return c.ClientConnect
+	case *Transfer_HttpRequest:
+		return c.HttpRequest
+	case *Transfer_HttpResponse:
+		return c.HttpResponse
+	case *Transfer_BodyChunk:
+		return c.BodyChunk
+	case *Transfer_Error:
+		return c.Error
+	}
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package commands
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+// URL parses the request URI. Absolute-form URIs keep their scheme and
+// host; use ResolveURL to build the URL a request is forwarded to.
+func (x *HttpRequest) URL() (*url.URL, error) {
+	uri := x.GetUri()
+	if uri == "" {
+		uri = "/"
+	}
+
+	return url.ParseRequestURI(uri)
+}
+
+// Path returns the decoded request path, or "" if the URI is invalid.
+func (x *HttpRequest) Path() string {
+	u, err := x.URL()
+	if err != nil {
+		return ""
+	}
+	if u.Path == "" {
+		return "/"
+	}
+
+	return u.Path
+}
+
+// Query returns the parsed query string. Malformed pairs are dropped.
+func (x *HttpRequest) Query() url.Values {
+	u, err := x.URL()
+	if err != nil {
+		return url.Values{}
+	}
+
+	return u.Query()
+}
+
+func (x *HttpRequest) QueryValue(key string) string {
+	return x.Query().Get(key)
+}
+
+// SetQuery replaces the query string of the request URI.
+func (x *HttpRequest) SetQuery(q url.Values) error {
+	u, err := x.URL()
+	if err != nil {
+		return err
+	}
+	u.RawQuery = q.Encode()
+	x.Uri = u.RequestURI()
+
+	return nil
+}
+
+func normalizePrefix(prefix string) string {
+	return "/" + strings.Trim(prefix, "/")
+}
+
+// HasPrefix reports whether the request path lies under prefix, matching
+// whole segments only: "/app" covers "/app" and "/app/x" but not "/apps".
+func (x *HttpRequest) HasPrefix(prefix string) bool {
+	_, ok := stripPrefix(x.Path(), normalizePrefix(prefix))
+	return ok
+}
+
+func stripPrefix(p, prefix string) (string, bool) {
+	if prefix == "/" {
+		return p, true
+	}
+	if !strings.HasPrefix(p, prefix) {
+		return "", false
+	}
+
+	rest := p[len(prefix):]
+	switch {
+	case rest == "":
+		return "/", true
+	case rest[0] == '/':
+		return rest, true
+	}
+
+	return "", false
+}
+
+// StripPrefix removes prefix from the request path, as the tunnel does when
+// it routes by ServerConnect.prefix. It reports false and leaves the URI
+// alone when the path is not under prefix.
+func (x *HttpRequest) StripPrefix(prefix string) bool {
+	u, err := x.URL()
+	if err != nil {
+		return false
+	}
+
+	prefix = normalizePrefix(prefix)
+	escaped, ok := stripPrefix(u.EscapedPath(), (&url.URL{Path: prefix}).EscapedPath())
+	if !ok {
+		return false
+	}
+	if err = setEscapedPath(u, escaped); err != nil {
+		return false
+	}
+	x.Uri = u.RequestURI()
+
+	return true
+}
+
+// AddPrefix puts prefix in front of the request path.
+func (x *HttpRequest) AddPrefix(prefix string) error {
+	u, err := x.URL()
+	if err != nil {
+		return err
+	}
+
+	prefix = normalizePrefix(prefix)
+	if prefix != "/" {
+		p := u.EscapedPath()
+		if p == "" || p == "/" {
+			p = ""
+		}
+		if err = setEscapedPath(u, (&url.URL{Path: prefix}).EscapedPath()+p); err != nil {
+			return err
+		}
+	}
+	x.Uri = u.RequestURI()
+
+	return nil
+}
+
+func setEscapedPath(u *url.URL, escaped string) error {
+	p, err := url.PathUnescape(escaped)
+	if err != nil {
+		return err
+	}
+	u.Path, u.RawPath = p, escaped
+
+	return nil
+}
+
+// cleanPath resolves dot segments, keeping a trailing slash.
+func cleanPath(p string) string {
+	cleaned := path.Clean("/" + p)
+	if strings.HasSuffix(p, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+
+	return cleaned
+}
+
+var encodedDot = strings.NewReplacer("%2e", ".", "%2E", ".")
+
+// ResolveURL returns the URL to forward the request to on the local
+// service at base. Only the path and query of the request are used, and dot
+// segments are resolved before joining, so the result always stays on the
+// host of base and under its path. The path keeps its escaping, so an
+// encoded slash still reaches the service as %2F.
+func (x *HttpRequest) ResolveURL(base *url.URL) (*url.URL, error) {
+	u, err := x.URL()
+	if err != nil {
+		return nil, err
+	}
+
+	// An encoded dot is still a dot, so it must not hide a dot segment.
+	escaped := cleanPath(encodedDot.Replace(u.EscapedPath()))
+
+	out := *base
+	if err = setEscapedPath(&out, strings.TrimSuffix(base.EscapedPath(), "/")+escaped); err != nil {
+		return nil, err
+	}
+	out.RawQuery = u.RawQuery
+	out.Fragment = ""
+	out.RawFragment = ""
+
+	return &out, nil
+}
@@ -0,0 +1,47 @@
+package commands_test
+
+import (
+	"github.com/black40x/tunl-core/commands"
+	"net/url"
+	"testing"
+)
+
+func TestResolveURL(t *testing.T) {
+	base := &url.URL{Scheme: "http", Host: "127.0.0.1:8080", Path: "/app/"}
+
+	tests := []struct {
+		uri, want string
+	}{
+		{"/", "http://127.0.0.1:8080/app/"},
+		{"/a/b?x=1", "http://127.0.0.1:8080/app/a/b?x=1"},
+		{"/repo/a%2Fb/file", "http://127.0.0.1:8080/app/repo/a%2Fb/file"},
+		{"/a%20b/", "http://127.0.0.1:8080/app/a%20b/"},
+		{"/../../etc/passwd", "http://127.0.0.1:8080/app/etc/passwd"},
+		{"/a/%2e%2e/%2E%2E/b", "http://127.0.0.1:8080/app/b"},
+		{"http://evil.example/x?y", "http://127.0.0.1:8080/app/x?y"},
+	}
+
+	for _, tt := range tests {
+		req := &commands.HttpRequest{Uri: tt.uri}
+		u, err := req.ResolveURL(base)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.uri, err)
+		}
+		if u.String() != tt.want {
+			t.Errorf("ResolveURL(%q) = %s, want %s", tt.uri, u, tt.want)
+		}
+	}
+}
+
+func TestStripPrefix(t *testing.T) {
+	req := &commands.HttpRequest{Uri: "/app/a%2Fb?q=1"}
+	if !req.StripPrefix("/app") || req.GetUri() != "/a%2Fb?q=1" {
+		t.Fatalf("StripPrefix gave %q", req.GetUri())
+	}
+	if req.StripPrefix("/a") {
+		t.Fatal("StripPrefix matched a partial segment")
+	}
+	if err := req.AddPrefix("/app"); err != nil || req.GetUri() != "/app/a%2Fb?q=1" {
+		t.Fatalf("AddPrefix gave %q, %v", req.GetUri(), err)
+	}
+}
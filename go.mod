@@ -1,5 +1,12 @@
 module github.com/black40x/tunl-core
 
-go 1.19
+go 1.22
 
-require google.golang.org/protobuf v1.28.1
+require (
+	github.com/andybalholm/brotli v1.1.1
+	github.com/klauspost/compress v1.18.0
+	golang.org/x/crypto v0.9.0
+	google.golang.org/protobuf v1.28.1
+)
+
+require golang.org/x/sys v0.9.0 // indirect
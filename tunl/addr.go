@@ -3,9 +3,16 @@ package tunl
 import (
 	"errors"
 	"fmt"
+	"github.com/black40x/tunl-core/commands"
+	"net/url"
+	"path"
+	"path/filepath"
 	"regexp"
+	"strings"
 )
 
+var ErrorInvalidPath = errors.New("invalid path")
+
 type AddrType byte
 
 const (
@@ -88,3 +95,28 @@ func (a Address) ToString() string {
 
 	return a.addr
 }
+
+// ForwardURL returns where req is forwarded to on this address. Directory
+// addresses give a file URL that never leaves the directory; since file
+// names cannot hold a slash, paths with an encoded one are rejected there.
+func (a Address) ForwardURL(req *commands.HttpRequest) (*url.URL, error) {
+	if a.addrType == DIR {
+		// Both dir://var/www and dir:///var/www name /var/www.
+		dir := path.Clean("/" + filepath.ToSlash(a.ToString()))
+		u, err := req.ResolveURL(&url.URL{Scheme: "file", Path: dir})
+		if err != nil {
+			return nil, err
+		}
+		if strings.Contains(strings.ToLower(u.EscapedPath()), "%2f") {
+			return nil, ErrorInvalidPath
+		}
+		return u, nil
+	}
+
+	base, err := url.Parse(a.ToProtoString())
+	if err != nil {
+		return nil, err
+	}
+
+	return req.ResolveURL(base)
+}
@@ -0,0 +1,37 @@
+package tunl_test
+
+import (
+	"github.com/black40x/tunl-core/commands"
+	"github.com/black40x/tunl-core/tunl"
+	"testing"
+)
+
+func TestForwardURL(t *testing.T) {
+	tests := []struct {
+		addr, uri, want string
+		err             error
+	}{
+		{"8080", "/a%2Fb", "http://127.0.0.1:8080/a%2Fb", nil},
+		{"http://localhost:3000/api", "/../x?y=1", "http://localhost:3000/api/x?y=1", nil},
+		{"dir://var/www", "/../../etc/passwd", "file:///var/www/etc/passwd", nil},
+		{"dir://var/www", "/..%2F..%2Fetc/passwd", "", tunl.ErrorInvalidPath},
+		{"dir:///var/www", "/index.html", "file:///var/www/index.html", nil},
+		{"dir:///var/www/", "/", "file:///var/www/", nil},
+		{"dir:////var//www", "/a/../b", "file:///var/www/b", nil},
+		{"dir:///", "/etc/passwd", "file:///etc/passwd", nil},
+	}
+
+	for _, tt := range tests {
+		a, err := tunl.NewAddress(tt.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u, err := a.ForwardURL(&commands.HttpRequest{Uri: tt.uri})
+		if err != tt.err {
+			t.Fatalf("%s %s: %v", tt.addr, tt.uri, err)
+		}
+		if err == nil && u.String() != tt.want {
+			t.Errorf("ForwardURL(%s, %s) = %s, want %s", tt.addr, tt.uri, u, tt.want)
+		}
+	}
+}
@@ -0,0 +1,339 @@
+package tunl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/black40x/tunl-core/commands"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrorAuthMissing = errors.New("credentials missing")
+	ErrorAuthInvalid = errors.New("invalid credentials")
+)
+
+// Authenticator protects a public URL. Authenticate returns the user a
+// request belongs to, ErrorAuthMissing when it carries no credentials of
+// the expected kind and ErrorAuthInvalid when they are wrong.
+type Authenticator interface {
+	Authenticate(req *commands.HttpRequest) (user string, err error)
+	// Challenge returns the WWW-Authenticate values sent with a 401.
+	Challenge(req *commands.HttpRequest) []string
+}
+
+var authParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+
+// quoteAuthParam makes s an RFC 7230 quoted-string.
+func quoteAuthParam(s string) string {
+	return `"` + authParamEscaper.Replace(s) + `"`
+}
+
+type BasicAuthenticator struct {
+	Realm  string
+	Verify func(user, password string) bool
+}
+
+func (a *BasicAuthenticator) Authenticate(req *commands.HttpRequest) (string, error) {
+	user, pass, ok := req.BasicAuth()
+	if !ok {
+		return "", ErrorAuthMissing
+	}
+	if !a.Verify(user, pass) {
+		return "", ErrorAuthInvalid
+	}
+
+	return user, nil
+}
+
+func (a *BasicAuthenticator) Challenge(*commands.HttpRequest) []string {
+	return []string{"Basic realm=" + quoteAuthParam(a.Realm) + `, charset="UTF-8"`}
+}
+
+type BearerAuthenticator struct {
+	Realm  string
+	Verify func(token string) (user string, ok bool)
+}
+
+func (a *BearerAuthenticator) Authenticate(req *commands.HttpRequest) (string, error) {
+	token, ok := req.BearerToken()
+	if !ok {
+		return "", ErrorAuthMissing
+	}
+	user, ok := a.Verify(token)
+	if !ok {
+		return "", ErrorAuthInvalid
+	}
+
+	return user, nil
+}
+
+func (a *BearerAuthenticator) Challenge(*commands.HttpRequest) []string {
+	return []string{"Bearer realm=" + quoteAuthParam(a.Realm)}
+}
+
+// APIKeyAuthenticator reads the key from Header or, failing that, from the
+// query parameter Param.
+type APIKeyAuthenticator struct {
+	Header string
+	Param  string
+	Verify func(key string) (user string, ok bool)
+}
+
+func (a *APIKeyAuthenticator) Authenticate(req *commands.HttpRequest) (string, error) {
+	key, ok := req.APIKey(a.Header, a.Param)
+	if !ok {
+		return "", ErrorAuthMissing
+	}
+	user, ok := a.Verify(key)
+	if !ok {
+		return "", ErrorAuthInvalid
+	}
+
+	return user, nil
+}
+
+func (a *APIKeyAuthenticator) Challenge(*commands.HttpRequest) []string {
+	return nil
+}
+
+// StaticKeys returns a Verify function for bearer tokens or API keys that
+// accepts the keys of users, mapping them to the user names.
+func StaticKeys(users map[string]string) func(key string) (string, bool) {
+	return func(key string) (string, bool) {
+		found, user := 0, ""
+		for k, u := range users {
+			if subtle.ConstantTimeCompare([]byte(k), []byte(key)) == 1 {
+				found, user = 1, u
+			}
+		}
+		return user, found == 1
+	}
+}
+
+const DefaultNonceTTL = 5 * time.Minute
+
+// DigestAuthenticator implements RFC 7616 digest authentication with
+// qop=auth. Nonces are stateless: they carry their issue time and are signed
+// with a random key, so they stay valid for NonceTTL. The nonce count of
+// every nonce in use is tracked, so a captured response cannot be replayed.
+// The zero value of the optional fields picks the defaults, so it can also
+// be built as a struct literal.
+type DigestAuthenticator struct {
+	Realm string
+	// HA1 returns DigestHA1 of the user's password for the algorithm.
+	HA1 func(user, realm, algorithm string) (string, bool)
+	// NonceTTL is how long a nonce is accepted, DefaultNonceTTL by default.
+	NonceTTL time.Duration
+	// Clock is SystemClock by default.
+	Clock Clock
+
+	once    sync.Once
+	key     [32]byte
+	keyErr  error
+	mu      sync.Mutex
+	counts  map[string]uint64
+	expires map[string]time.Time
+}
+
+func NewDigestAuthenticator(realm string, ha1 func(user, realm, algorithm string) (string, bool)) *DigestAuthenticator {
+	return &DigestAuthenticator{
+		Realm:    realm,
+		HA1:      ha1,
+		NonceTTL: DefaultNonceTTL,
+		Clock:    SystemClock,
+	}
+}
+
+func (a *DigestAuthenticator) init() error {
+	a.once.Do(func() {
+		_, a.keyErr = rand.Read(a.key[:])
+		a.counts = map[string]uint64{}
+		a.expires = map[string]time.Time{}
+	})
+	return a.keyErr
+}
+
+func (a *DigestAuthenticator) now() time.Time {
+	if a.Clock == nil {
+		return SystemClock.Now()
+	}
+	return a.Clock.Now()
+}
+
+func (a *DigestAuthenticator) ttl() time.Duration {
+	if a.NonceTTL <= 0 {
+		return DefaultNonceTTL
+	}
+	return a.NonceTTL
+}
+
+func (a *DigestAuthenticator) sign(issued []byte) []byte {
+	m := hmac.New(sha256.New, a.key[:])
+	m.Write(issued)
+	m.Write([]byte(a.Realm))
+	return m.Sum(nil)
+}
+
+func (a *DigestAuthenticator) nonce() (string, error) {
+	if err := a.init(); err != nil {
+		return "", err
+	}
+	issued := binary.BigEndian.AppendUint64(nil, uint64(a.now().UnixNano()))
+	return base64.RawURLEncoding.EncodeToString(append(issued, a.sign(issued)...)), nil
+}
+
+// checkNonce reports whether the nonce is ours and whether it is still
+// fresh, along with the time it expires.
+func (a *DigestAuthenticator) checkNonce(nonce string) (valid, fresh bool, expires time.Time) {
+	if a.init() != nil {
+		return false, false, time.Time{}
+	}
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 8+sha256.Size || !hmac.Equal(b[8:], a.sign(b[:8])) {
+		return false, false, time.Time{}
+	}
+	expires = time.Unix(0, int64(binary.BigEndian.Uint64(b[:8]))).Add(a.ttl())
+
+	return true, !a.now().After(expires), expires
+}
+
+// useNonceCount records nc for the nonce and reports false if it was not
+// higher than every count seen before. Expired nonces are forgotten.
+func (a *DigestAuthenticator) useNonceCount(nonce string, nc uint64, expires time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	for n, e := range a.expires {
+		if now.After(e) {
+			delete(a.expires, n)
+			delete(a.counts, n)
+		}
+	}
+
+	if last, ok := a.counts[nonce]; ok && nc <= last {
+		return false
+	}
+	a.counts[nonce] = nc
+	a.expires[nonce] = expires
+
+	return true
+}
+
+func (a *DigestAuthenticator) Authenticate(req *commands.HttpRequest) (string, error) {
+	if err := a.init(); err != nil {
+		return "", err
+	}
+
+	d, ok := req.DigestAuth()
+	if !ok {
+		return "", ErrorAuthMissing
+	}
+	if d.Realm != a.Realm || d.URI != req.GetUri() || d.QOP != "auth" {
+		return "", ErrorAuthInvalid
+	}
+	nc, err := strconv.ParseUint(d.NC, 16, 32)
+	if err != nil || nc == 0 {
+		return "", ErrorAuthInvalid
+	}
+	valid, fresh, expires := a.checkNonce(d.Nonce)
+	if !valid || !fresh {
+		return "", ErrorAuthInvalid
+	}
+
+	ha1, ok := a.HA1(d.Username, a.Realm, d.Algorithm)
+	if !ok || !d.Verify(req.GetMethod(), ha1) {
+		return "", ErrorAuthInvalid
+	}
+	if !a.useNonceCount(d.Nonce, nc, expires) {
+		return "", ErrorAuthInvalid
+	}
+
+	return d.Username, nil
+}
+
+// Challenge offers SHA-256 and MD5, flagging stale nonces so that clients
+// retry without asking the user again.
+func (a *DigestAuthenticator) Challenge(req *commands.HttpRequest) []string {
+	nonce, err := a.nonce()
+	if err != nil {
+		return nil
+	}
+
+	stale := ""
+	if d, ok := req.DigestAuth(); ok {
+		if valid, fresh, _ := a.checkNonce(d.Nonce); valid && !fresh {
+			stale = ", stale=true"
+		}
+	}
+
+	var challenges []string
+	for _, alg := range []string{"SHA-256", "MD5"} {
+		challenges = append(challenges, "Digest realm="+quoteAuthParam(a.Realm)+
+			`, qop="auth", algorithm=`+alg+", nonce="+quoteAuthParam(nonce)+stale)
+	}
+
+	return challenges
+}
+
+// MultiAuthenticator accepts a request any of its authenticators accepts.
+type MultiAuthenticator []Authenticator
+
+func (m MultiAuthenticator) Authenticate(req *commands.HttpRequest) (string, error) {
+	err := ErrorAuthMissing
+	for _, a := range m {
+		user, e := a.Authenticate(req)
+		if e == nil {
+			return user, nil
+		}
+		if e != ErrorAuthMissing {
+			err = e
+		}
+	}
+
+	return "", err
+}
+
+func (m MultiAuthenticator) Challenge(req *commands.HttpRequest) []string {
+	var challenges []string
+	for _, a := range m {
+		challenges = append(challenges, a.Challenge(req)...)
+	}
+
+	return challenges
+}
+
+// Unauthorized builds the 401 answer to req with the challenges of a.
+func (p *Pages) Unauthorized(req *commands.HttpRequest, a Authenticator) (*commands.HttpResponse, *commands.BodyChunk) {
+	resp, chunk := p.Response(req, ErrorUnauthorized)
+	for _, c := range a.Challenge(req) {
+		resp.Headers().Add("WWW-Authenticate", c)
+	}
+
+	return resp, chunk
+}
+
+// Authorize checks req with a. When it fails, the 401 answer rendered with
+// p is returned and should be sent instead of forwarding the request.
+func (p *Pages) Authorize(a Authenticator, req *commands.HttpRequest) (string, *commands.HttpResponse, *commands.BodyChunk) {
+	user, err := a.Authenticate(req)
+	if err == nil {
+		return user, nil, nil
+	}
+
+	resp, chunk := p.Unauthorized(req, a)
+	return "", resp, chunk
+}
+
+// Authorize is Pages.Authorize using DefaultPages.
+func Authorize(a Authenticator, req *commands.HttpRequest) (string, *commands.HttpResponse, *commands.BodyChunk) {
+	return DefaultPages.Authorize(a, req)
+}
@@ -0,0 +1,103 @@
+package tunl_test
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/black40x/tunl-core/commands"
+	"github.com/black40x/tunl-core/tunl"
+	"github.com/black40x/tunl-core/tunl/tunltest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func md5Hex(parts ...string) string {
+	sum := md5.Sum([]byte(strings.Join(parts, ":")))
+	return hex.EncodeToString(sum[:])
+}
+
+// challengeNonce returns the nonce of the first challenge a issues.
+func challengeNonce(t *testing.T, a tunl.Authenticator) string {
+	t.Helper()
+
+	for _, c := range a.Challenge(&commands.HttpRequest{}) {
+		_, rest, _ := strings.Cut(c, `nonce="`)
+		if nonce, _, ok := strings.Cut(rest, `"`); ok {
+			return nonce
+		}
+	}
+	t.Fatal("no nonce in challenge")
+	return ""
+}
+
+func digestRequest(realm, nonce, user, pass string, nc int) *commands.HttpRequest {
+	const method, uri, cnonce = "GET", "/private", "0a4f113b"
+
+	ncs := fmt.Sprintf("%08x", nc)
+	response := md5Hex(md5Hex(user, realm, pass), nonce, ncs, cnonce, "auth", md5Hex(method, uri))
+
+	req := &commands.HttpRequest{Method: method, Uri: uri}
+	req.Headers().Set("Authorization", fmt.Sprintf(
+		`Digest username="%s", realm="%s", nonce="%s", uri="%s", algorithm=MD5, qop=auth, nc=%s, cnonce="%s", response="%s"`,
+		user, realm, nonce, uri, ncs, cnonce, response))
+
+	return req
+}
+
+func digestHA1(user, realm, algorithm string) (string, bool) {
+	if user != "alice" {
+		return "", false
+	}
+	return commands.DigestHA1(algorithm, user, realm, "secret"), true
+}
+
+func TestDigestAuthenticatorLiteral(t *testing.T) {
+	a := &tunl.DigestAuthenticator{Realm: "tunl", HA1: digestHA1}
+	nonce := challengeNonce(t, a)
+
+	user, err := a.Authenticate(digestRequest("tunl", nonce, "alice", "secret", 1))
+	if err != nil || user != "alice" {
+		t.Fatalf("Authenticate() = %q, %v", user, err)
+	}
+	if _, err = a.Authenticate(digestRequest("tunl", nonce, "alice", "wrong", 2)); err != tunl.ErrorAuthInvalid {
+		t.Fatalf("wrong password: %v", err)
+	}
+
+	other := &tunl.DigestAuthenticator{Realm: "tunl", HA1: digestHA1}
+	if _, err = other.Authenticate(digestRequest("tunl", nonce, "alice", "secret", 1)); err != tunl.ErrorAuthInvalid {
+		t.Fatalf("nonce accepted by another authenticator: %v", err)
+	}
+}
+
+func TestDigestAuthenticatorReplay(t *testing.T) {
+	a := tunl.NewDigestAuthenticator("tunl", digestHA1)
+	nonce := challengeNonce(t, a)
+
+	req := digestRequest("tunl", nonce, "alice", "secret", 1)
+	if _, err := a.Authenticate(req); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Authenticate(req); err != tunl.ErrorAuthInvalid {
+		t.Fatalf("replayed response: %v", err)
+	}
+	if _, err := a.Authenticate(digestRequest("tunl", nonce, "alice", "secret", 2)); err != nil {
+		t.Fatalf("next nonce count: %v", err)
+	}
+}
+
+func TestDigestAuthenticatorStale(t *testing.T) {
+	clock := tunltest.NewFakeClock(time.Unix(1000, 0))
+	a := tunl.NewDigestAuthenticator("tunl", digestHA1)
+	a.Clock = clock
+	nonce := challengeNonce(t, a)
+
+	clock.Advance(tunl.DefaultNonceTTL + time.Second)
+	req := digestRequest("tunl", nonce, "alice", "secret", 1)
+	if _, err := a.Authenticate(req); err != tunl.ErrorAuthInvalid {
+		t.Fatalf("stale nonce: %v", err)
+	}
+	if c := a.Challenge(req); len(c) == 0 || !strings.HasSuffix(c[0], "stale=true") {
+		t.Fatalf("Challenge() = %v", c)
+	}
+}
@@ -0,0 +1,91 @@
+package tunl_test
+
+import (
+	"bytes"
+	"github.com/black40x/tunl-core/commands"
+	"github.com/black40x/tunl-core/tunl"
+	"github.com/black40x/tunl-core/tunl/tunltest"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"testing"
+)
+
+// frameSource replays the same frame n times and then reports EOF.
+type frameSource struct {
+	frame []byte
+	n     int
+	r     bytes.Reader
+}
+
+func newFrameSource(b *testing.B, m proto.Message, n int) *frameSource {
+	data, err := proto.Marshal(commands.NewTransfer(m))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	return &frameSource{frame: tunltest.EncodeFrame(data, false), n: n}
+}
+
+func (s *frameSource) Read(p []byte) (int, error) {
+	if s.r.Len() == 0 {
+		if s.n == 0 {
+			return 0, io.EOF
+		}
+		s.n--
+		s.r.Reset(s.frame)
+	}
+	return s.r.Read(p)
+}
+
+func (s *frameSource) Write(p []byte) (int, error) { return len(p), nil }
+
+func (s *frameSource) Close() error { return nil }
+
+func benchChunk() *commands.BodyChunk {
+	return &commands.BodyChunk{Uuid: "0b7e5a9c-6a2f-4f0e-9f59-3c8a2c1d4e5f", Body: bytes.Repeat([]byte("x"), 8<<10)}
+}
+
+func BenchmarkReadFrame(b *testing.B) {
+	src := newFrameSource(b, benchChunk(), b.N)
+	tr := tunl.NewStreamTransport(src, nil)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(src.frame)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := tr.ReadFrame(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkHandleConnection(b *testing.B) {
+	for _, reuse := range []bool{false, true} {
+		name := "ReuseTransfer=false"
+		if reuse {
+			name = "ReuseTransfer=true"
+		}
+
+		b.Run(name, func(b *testing.B) {
+			cfg := tunl.DefaultConfig()
+			cfg.ReuseTransfer = reuse
+			src := newFrameSource(b, benchChunk(), b.N)
+			c := tunl.NewTunlConnTransport(tunl.NewStreamTransport(src, cfg), cfg)
+
+			n := 0
+			c.SetOnCommand(func(cmd *commands.Transfer) {
+				n++
+			})
+
+			b.ReportAllocs()
+			b.SetBytes(int64(len(src.frame)))
+			b.ResetTimer()
+			c.HandleConnection()
+			b.StopTimer()
+
+			if n != b.N {
+				b.Fatalf("handled %d of %d frames", n, b.N)
+			}
+		})
+	}
+}
@@ -0,0 +1,345 @@
+package tunl
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"github.com/black40x/tunl-core/commands"
+	"github.com/klauspost/compress/snappy"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"strings"
+	"sync"
+)
+
+const DefaultCompressMinSize = 512
+
+var (
+	ErrorUnknownCompression = errors.New("unknown compression")
+	ErrorFrameTooLarge      = errors.New("frame too large")
+)
+
+// Compressor compresses whole frame payloads. Implementations must be safe
+// for concurrent use.
+type Compressor interface {
+	Name() string
+	// Compress appends the compressed form of src to dst.
+	Compress(dst, src []byte) ([]byte, error)
+	// Decompress appends the decompressed form of src to dst and fails with
+	// ErrorFrameTooLarge once more than limit bytes would be produced.
+	Decompress(dst, src []byte, limit int) ([]byte, error)
+}
+
+var (
+	compressorsMu sync.RWMutex
+	compressors   []Compressor
+)
+
+func init() {
+	RegisterCompressor(newZstdCompressor())
+	RegisterCompressor(&gzipCompressor{})
+	RegisterCompressor(&flateCompressor{})
+	RegisterCompressor(snappyCompressor{})
+}
+
+// RegisterCompressor makes c available for negotiation, replacing any
+// compressor with the same name.
+func RegisterCompressor(c Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+
+	for i, e := range compressors {
+		if e.Name() == c.Name() {
+			compressors[i] = c
+			return
+		}
+	}
+	compressors = append(compressors, c)
+}
+
+func GetCompressor(name string) Compressor {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	for _, c := range compressors {
+		if c.Name() == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// SupportedCompression lists the registered compressors in order of
+// preference, ready to be offered in ServerHeader.Compression.
+func SupportedCompression() []string {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	names := make([]string, 0, len(compressors))
+	for _, c := range compressors {
+		names = append(names, c.Name())
+	}
+	return names
+}
+
+// NegotiateCompression returns the first offered compressor that is
+// registered locally, or an empty string if there is none.
+func NegotiateCompression(offered []string) string {
+	for _, name := range offered {
+		if GetCompressor(name) != nil {
+			return name
+		}
+	}
+	return ""
+}
+
+type appendWriter struct {
+	b []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+func readLimited(dst []byte, r io.Reader, limit int) ([]byte, error) {
+	w := &appendWriter{b: dst}
+	n, err := io.Copy(w, io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return dst, err
+	}
+	if n > int64(limit) {
+		return dst, ErrorFrameTooLarge
+	}
+	return w.b, nil
+}
+
+type gzipCompressor struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (g *gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (g *gzipCompressor) Compress(dst, src []byte) ([]byte, error) {
+	w := &appendWriter{b: dst}
+	zw, ok := g.writers.Get().(*gzip.Writer)
+	if ok {
+		zw.Reset(w)
+	} else {
+		zw = gzip.NewWriter(w)
+	}
+	defer g.writers.Put(zw)
+
+	if _, err := zw.Write(src); err != nil {
+		return dst, err
+	}
+	if err := zw.Close(); err != nil {
+		return dst, err
+	}
+	return w.b, nil
+}
+
+func (g *gzipCompressor) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	zr, ok := g.readers.Get().(*gzip.Reader)
+	var err error
+	if ok {
+		err = zr.Reset(bytes.NewReader(src))
+	} else {
+		zr, err = gzip.NewReader(bytes.NewReader(src))
+	}
+	if err != nil {
+		return dst, err
+	}
+	defer g.readers.Put(zr)
+
+	return readLimited(dst, zr, limit)
+}
+
+type flateCompressor struct {
+	writers sync.Pool
+}
+
+func (f *flateCompressor) Name() string {
+	return "deflate"
+}
+
+func (f *flateCompressor) Compress(dst, src []byte) ([]byte, error) {
+	w := &appendWriter{b: dst}
+	zw, ok := f.writers.Get().(*flate.Writer)
+	if ok {
+		zw.Reset(w)
+	} else {
+		zw, _ = flate.NewWriter(w, flate.DefaultCompression)
+	}
+	defer f.writers.Put(zw)
+
+	if _, err := zw.Write(src); err != nil {
+		return dst, err
+	}
+	if err := zw.Close(); err != nil {
+		return dst, err
+	}
+	return w.b, nil
+}
+
+func (f *flateCompressor) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	zr := flate.NewReader(bytes.NewReader(src))
+	defer zr.Close()
+
+	return readLimited(dst, zr, limit)
+}
+
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+	readers sync.Pool
+}
+
+func newZstdCompressor() *zstdCompressor {
+	// EncodeAll is safe for concurrent use, so one encoder serves every
+	// connection.
+	enc, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	return &zstdCompressor{encoder: enc}
+}
+
+func (z *zstdCompressor) Name() string {
+	return "zstd"
+}
+
+func (z *zstdCompressor) Compress(dst, src []byte) ([]byte, error) {
+	return z.encoder.EncodeAll(src, dst), nil
+}
+
+func (z *zstdCompressor) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	zr, ok := z.readers.Get().(*zstd.Decoder)
+	var err error
+	if ok {
+		err = zr.Reset(bytes.NewReader(src))
+	} else {
+		zr, err = zstd.NewReader(bytes.NewReader(src), zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	}
+	if err != nil {
+		return dst, err
+	}
+	defer func() {
+		zr.Reset(nil)
+		z.readers.Put(zr)
+	}()
+
+	return readLimited(dst, zr, limit)
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Name() string {
+	return "snappy"
+}
+
+func (snappyCompressor) Compress(dst, src []byte) ([]byte, error) {
+	n := len(dst)
+	if m := n + snappy.MaxEncodedLen(len(src)); cap(dst) < m {
+		dst = append(dst[:cap(dst)], make([]byte, m-cap(dst))...)
+	}
+	out := snappy.Encode(dst[n:cap(dst)], src)
+
+	return dst[:n+len(out)], nil
+}
+
+func (snappyCompressor) Decompress(dst, src []byte, limit int) ([]byte, error) {
+	size, err := snappy.DecodedLen(src)
+	if err != nil {
+		return dst, err
+	}
+	if size > limit {
+		return dst, ErrorFrameTooLarge
+	}
+
+	n := len(dst)
+	if cap(dst) < n+size {
+		dst = append(dst[:cap(dst)], make([]byte, n+size-cap(dst))...)
+	}
+	out, err := snappy.Decode(dst[n:n+size], src)
+	if err != nil {
+		return dst[:n], err
+	}
+
+	return dst[:n+len(out)], nil
+}
+
+var incompressibleTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/gzip",
+	"application/x-gzip",
+	"application/zstd",
+	"application/x-7z-compressed",
+	"application/x-rar-compressed",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/pdf",
+	"application/octet-stream",
+}
+
+// isCompressed reports whether a body with these headers is unlikely to
+// shrink any further.
+func isCompressed(contentType, contentEncoding string) bool {
+	if contentEncoding != "" && !strings.EqualFold(contentEncoding, "identity") {
+		return true
+	}
+	contentType = strings.ToLower(contentType)
+	if strings.HasPrefix(contentType, "image/svg") {
+		return false
+	}
+	for _, t := range incompressibleTypes {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressionFilter remembers streams whose body is already compressed so
+// their chunks are sent as is. An entry lives until the stream's EOF chunk,
+// so streams that end without one must be released with end.
+type compressionFilter struct {
+	skip sync.Map
+}
+
+func (c *compressionFilter) allow(m interface{}) bool {
+	switch m := m.(type) {
+	case *commands.HttpRequest:
+		if isCompressed(m.GetHeaderValue("Content-Type"), m.GetHeaderValue("Content-Encoding")) {
+			c.skip.Store(m.GetUuid(), struct{}{})
+		}
+	case *commands.HttpResponse:
+		if !responseHasBody(m) {
+			c.end(m.GetUuid())
+		} else if isCompressed(m.GetHeaderValue("Content-Type"), m.GetHeaderValue("Content-Encoding")) {
+			c.skip.Store(m.GetUuid(), struct{}{})
+		}
+	case *commands.BodyChunk:
+		_, skip := c.skip.Load(m.GetUuid())
+		if m.GetEof() {
+			c.end(m.GetUuid())
+		}
+		return !skip && !m.GetSealed()
+	}
+	return true
+}
+
+func (c *compressionFilter) end(uuid string) {
+	c.skip.Delete(uuid)
+}
+
+// responseHasBody reports whether body chunks may follow m. Error responses
+// and 1xx, 204 and 304 responses never carry a body.
+func responseHasBody(m *commands.HttpResponse) bool {
+	s := m.GetStatus()
+	return m.GetErrorCode() == 0 && s >= 200 && s != 204 && s != 304
+}
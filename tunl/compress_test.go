@@ -0,0 +1,49 @@
+package tunl_test
+
+import (
+	"bytes"
+	"github.com/black40x/tunl-core/tunl"
+	"testing"
+)
+
+func TestCompressors(t *testing.T) {
+	src := bytes.Repeat([]byte("<p>hello tunnel</p>\n"), 1000)
+
+	for _, name := range []string{"zstd", "gzip", "deflate", "snappy"} {
+		t.Run(name, func(t *testing.T) {
+			c := tunl.GetCompressor(name)
+			if c == nil {
+				t.Fatal("not registered")
+			}
+
+			packed, err := c.Compress([]byte("head"), src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(packed, []byte("head")) || len(packed) >= len(src) {
+				t.Fatalf("Compress returned %d bytes", len(packed))
+			}
+
+			out, err := c.Decompress([]byte("head"), packed[4:], len(src))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(out[4:], src) || string(out[:4]) != "head" {
+				t.Fatal("round trip mismatch")
+			}
+
+			if _, err = c.Decompress(nil, packed[4:], len(src)-1); err != tunl.ErrorFrameTooLarge {
+				t.Fatalf("Decompress over limit: %v", err)
+			}
+		})
+	}
+}
+
+func TestNegotiateCompression(t *testing.T) {
+	if got := tunl.SupportedCompression(); len(got) < 4 || got[0] != "zstd" {
+		t.Fatalf("SupportedCompression() = %v", got)
+	}
+	if got := tunl.NegotiateCompression([]string{"br", "snappy", "gzip"}); got != "snappy" {
+		t.Fatalf("NegotiateCompression = %q", got)
+	}
+}
@@ -0,0 +1,90 @@
+package tunl
+
+import "time"
+
+const (
+	DefaultReadBufferSize  = 64 << 10
+	DefaultWriteBufferSize = 64 << 10
+	DefaultFlushThreshold  = 32 << 10
+	DefaultSendQueueSize   = 1024
+	DefaultWriteTimeout    = 30 * time.Second
+	DefaultMaxFrameSize    = 16 << 20
+)
+
+type Config struct {
+	// ReadBufferSize is the size of the buffered reader in front of the
+	// connection.
+	ReadBufferSize int
+	// ReuseTransfer makes HandleConnection decode every frame into the same
+	// Transfer. The command callback must not keep the message after it
+	// returns.
+	ReuseTransfer bool
+	// WriteBufferSize is the size of the buffered writer in front of the
+	// connection.
+	WriteBufferSize int
+	// FlushThreshold forces a flush once that many bytes are buffered.
+	FlushThreshold int
+	// FlushInterval is the longest time a frame may sit in the buffer. Zero
+	// flushes as soon as no other writer is waiting for the connection.
+	FlushInterval time.Duration
+	// WriteTimeout bounds every write to the connection and, with the
+	// QueueBlock policy, how long Send waits for room in the queue. Zero
+	// disables the deadline.
+	WriteTimeout time.Duration
+	// SendQueueSize is the number of frames that may wait to be written.
+	SendQueueSize int
+	// SendQueuePolicy decides what happens to frames that overflow the
+	// send queue.
+	SendQueuePolicy QueuePolicy
+	// CompressMinSize is the smallest payload worth compressing once a
+	// compressor has been negotiated with SetCompression.
+	CompressMinSize int
+	// MaxFrameSize is the largest payload accepted from the peer, after
+	// decompression.
+	MaxFrameSize int
+	// Clock drives session expiry. Tests can swap it for a fake one.
+	Clock Clock
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ReadBufferSize:  DefaultReadBufferSize,
+		WriteBufferSize: DefaultWriteBufferSize,
+		FlushThreshold:  DefaultFlushThreshold,
+		WriteTimeout:    DefaultWriteTimeout,
+		SendQueueSize:   DefaultSendQueueSize,
+		CompressMinSize: DefaultCompressMinSize,
+		MaxFrameSize:    DefaultMaxFrameSize,
+		Clock:           SystemClock,
+	}
+}
+
+func (c *Config) withDefaults() *Config {
+	cfg := DefaultConfig()
+	if c == nil {
+		return cfg
+	}
+	*cfg = *c
+	if cfg.ReadBufferSize <= 0 {
+		cfg.ReadBufferSize = DefaultReadBufferSize
+	}
+	if cfg.WriteBufferSize <= 0 {
+		cfg.WriteBufferSize = DefaultWriteBufferSize
+	}
+	if cfg.FlushThreshold <= 0 || cfg.FlushThreshold > cfg.WriteBufferSize {
+		cfg.FlushThreshold = cfg.WriteBufferSize
+	}
+	if cfg.SendQueueSize <= 0 {
+		cfg.SendQueueSize = DefaultSendQueueSize
+	}
+	if cfg.CompressMinSize <= 0 {
+		cfg.CompressMinSize = DefaultCompressMinSize
+	}
+	if cfg.MaxFrameSize <= 0 {
+		cfg.MaxFrameSize = DefaultMaxFrameSize
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = SystemClock
+	}
+	return cfg
+}
@@ -0,0 +1,134 @@
+package conformance
+
+import (
+	"embed"
+	"encoding/binary"
+	"github.com/black40x/tunl-core/commands"
+	"github.com/black40x/tunl-core/tunl"
+	"google.golang.org/protobuf/proto"
+)
+
+//go:generate go run gen.go
+
+//go:embed golden
+var golden embed.FS
+
+// Case is one command of the conformance corpus. Its golden frame lives in
+// golden/<Name>.bin and is the exact bytes expected on the wire.
+type Case struct {
+	Name    string
+	Message proto.Message
+}
+
+// Transfer wraps the case message the way it is sent on the wire.
+func (c Case) Transfer() *commands.Transfer {
+	if c.Message == nil {
+		return &commands.Transfer{}
+	}
+	return commands.NewTransfer(c.Message)
+}
+
+func (c Case) Golden() ([]byte, error) {
+	return golden.ReadFile("golden/" + c.Name + ".bin")
+}
+
+// Encode returns the uncompressed frame for the case: the length prefix
+// followed by the deterministic encoding of the Transfer.
+func (c Case) Encode() ([]byte, error) {
+	frame := make([]byte, tunl.FramePrefixSize)
+	frame, err := proto.MarshalOptions{Deterministic: true}.MarshalAppend(frame, c.Transfer())
+	if err != nil {
+		return nil, err
+	}
+	binary.BigEndian.PutUint32(frame, uint32(len(frame)))
+
+	return frame, nil
+}
+
+// Cases returns the corpus, one case per Transfer variant plus the edge
+// cases worth pinning down. Every call returns fresh messages.
+func Cases() []Case {
+	return []Case{
+		{Name: "empty"},
+		{Name: "server_header", Message: &commands.ServerHeader{
+			Version:     "1.0.0",
+			Private:     true,
+			Compression: []string{"gzip", "deflate"},
+		}},
+		{Name: "client_connect", Message: &commands.ClientConnect{
+			Password:    "secret",
+			Version:     "1.0.0",
+			Compression: "gzip",
+		}},
+		{Name: "server_connect", Message: &commands.ServerConnect{
+			Prefix:    "f3a9",
+			PublicUrl: "https://f3a9.tunl.online",
+			Expire:    1700000000,
+		}},
+		{Name: "http_request", Message: &commands.HttpRequest{
+			Uuid:          "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+			Proto:         "HTTP/1.1",
+			Method:        "POST",
+			Uri:           "/api/items?page=2&sort=name",
+			ContentLength: 13,
+			Cookies: []*commands.Cookie{{
+				Name:     "session",
+				Value:    "abc123",
+				Path:     "/",
+				Domain:   "f3a9.tunl.online",
+				Expires:  1700003600,
+				MaxAge:   3600,
+				Secure:   true,
+				HttpOnly: true,
+				SameSite: commands.Cookie_LAX,
+			}},
+			Header: []*commands.Header{
+				{Key: "Content-Type", Value: []string{"application/json"}},
+				{Key: "Accept", Value: []string{"text/html", "application/json"}},
+			},
+			RemoteAddr: "203.0.113.7:51234",
+		}},
+		{Name: "http_request_error", Message: &commands.HttpRequest{
+			Uuid:      "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+			ErrorCode: int64(tunl.ErrorServerRequest),
+		}},
+		{Name: "http_response", Message: &commands.HttpResponse{
+			Uuid:          "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+			Proto:         "HTTP/1.1",
+			Status:        201,
+			ContentLength: 2,
+			Header: []*commands.Header{
+				{Key: "Content-Type", Value: []string{"application/json; charset=utf-8"}},
+				{Key: "Set-Cookie", Value: []string{"a=1", "b=2"}},
+			},
+		}},
+		{Name: "http_response_error", Message: &commands.HttpResponse{
+			Uuid:      "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+			ErrorCode: int64(tunl.ErrorClientResponse),
+		}},
+		{Name: "body_chunk", Message: &commands.BodyChunk{
+			Uuid: "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+			Body: []byte(`{"name":"x"}` + "\n"),
+		}},
+		{Name: "body_chunk_binary", Message: &commands.BodyChunk{
+			Uuid: "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+			Body: []byte{0x00, 0xff, 0x80, 0x7f, 0x0a, 0x0d},
+		}},
+		{Name: "body_chunk_eof", Message: &commands.BodyChunk{
+			Uuid: "7c9e6679-7425-40de-944b-e07fc1f90ae7",
+			Eof:  true,
+		}},
+		{Name: "error", Message: &commands.Error{
+			Code:    tunl.ErrorSessionExpired,
+			Message: "session expired",
+		}},
+		{Name: "error_structured", Message: &commands.Error{
+			Code:         tunl.ErrorRateLimited,
+			Message:      "rate limited",
+			Category:     tunl.CategoryQuota,
+			Retryable:    true,
+			RetryAfterMs: 1500,
+			Details:      map[string]string{"limit": "100", "window": "1m"},
+		}},
+	}
+}
@@ -0,0 +1,61 @@
+package conformance_test
+
+import (
+	"github.com/black40x/tunl-core/commands"
+	"github.com/black40x/tunl-core/tunl"
+	"github.com/black40x/tunl-core/tunl/conformance"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	results := conformance.Verify()
+	if len(results) != len(conformance.Cases()) {
+		t.Fatalf("Verify ran %d of %d cases", len(results), len(conformance.Cases()))
+	}
+	for _, r := range conformance.Failed(results) {
+		t.Error(r)
+	}
+}
+
+func TestRunnerEcho(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go conformance.Echo(b)
+
+	r := &conformance.Runner{Timeout: 5 * time.Second}
+	results := r.Run(a)
+	if len(results) != len(conformance.Cases()) {
+		t.Fatalf("Run covered %d of %d cases", len(results), len(conformance.Cases()))
+	}
+	for _, r := range conformance.Failed(results) {
+		t.Error(r)
+	}
+}
+
+func TestRunnerDetectsChanges(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go func() {
+		c := tunl.NewTunlConn(b)
+		c.SetOnCommand(func(cmd *commands.Transfer) {
+			if chunk := cmd.GetBodyChunk(); chunk != nil {
+				chunk.Body = append(chunk.Body, '!')
+			}
+			c.Send(cmd.Message())
+		})
+		c.HandleConnection()
+	}()
+
+	r := &conformance.Runner{Timeout: 5 * time.Second}
+	failed := conformance.Failed(r.Run(a))
+	if len(failed) == 0 {
+		t.Fatal("altered body chunks passed")
+	}
+	for _, f := range failed {
+		if f.Err != conformance.ErrorCommandChanged {
+			t.Errorf("%s: %v", f.Case, f.Err)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build ignore
+
+// gen writes the golden frames of every conformance case.
+package main
+
+import (
+	"github.com/black40x/tunl-core/tunl/conformance"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+func main() {
+	for _, c := range conformance.Cases() {
+		frame, err := c.Encode()
+		if err != nil {
+			log.Fatalf("%s: %v", c.Name, err)
+		}
+		err = os.WriteFile(filepath.Join("golden", c.Name+".bin"), frame, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+}
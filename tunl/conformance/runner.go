@@ -0,0 +1,151 @@
+package conformance
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/black40x/tunl-core/commands"
+	"github.com/black40x/tunl-core/tunl"
+	"google.golang.org/protobuf/proto"
+	"net"
+	"time"
+)
+
+const DefaultTimeout = 5 * time.Second
+
+var (
+	ErrorGoldenMismatch = errors.New("frame does not match golden")
+	ErrorCommandChanged = errors.New("command changed in transit")
+)
+
+type Result struct {
+	Case string
+	Err  error
+}
+
+func (r Result) String() string {
+	if r.Err != nil {
+		return fmt.Sprintf("FAIL %s: %v", r.Case, r.Err)
+	}
+	return "ok   " + r.Case
+}
+
+// Failed returns the results that carry an error.
+func Failed(results []Result) []Result {
+	var failed []Result
+	for _, r := range results {
+		if r.Err != nil {
+			failed = append(failed, r)
+		}
+	}
+	return failed
+}
+
+// Verify checks this implementation against the golden corpus: each golden
+// frame must decode to its case, and encoding the case must reproduce the
+// golden bytes.
+func Verify() []Result {
+	var results []Result
+	for _, c := range Cases() {
+		results = append(results, Result{Case: c.Name, Err: verify(c)})
+	}
+	return results
+}
+
+func verify(c Case) error {
+	want, err := c.Golden()
+	if err != nil {
+		return err
+	}
+
+	got, err := c.Encode()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(got, want) {
+		return ErrorGoldenMismatch
+	}
+
+	client, server := tunl.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go client.WriteFrame(tunl.Frame{Payload: want[tunl.FramePrefixSize:]})
+
+	return expect(server, c)
+}
+
+func expect(tr tunl.Transport, c Case) error {
+	f, err := tr.ReadFrame()
+	if err != nil {
+		return err
+	}
+	if f.Compressed {
+		return ErrorCommandChanged
+	}
+
+	trans := &commands.Transfer{}
+	if err = proto.Unmarshal(f.Payload, trans); err != nil {
+		return err
+	}
+	if !proto.Equal(trans, c.Transfer()) {
+		return ErrorCommandChanged
+	}
+
+	return nil
+}
+
+// Runner validates another implementation of the protocol. The peer on the
+// other end of the connection must answer every command it receives by
+// sending the same command back, as Echo does.
+type Runner struct {
+	Timeout time.Duration
+}
+
+// Run writes every golden frame to conn and checks the command echoed back.
+// Byte equality is not required of the echo since protobuf encoders may
+// order fields differently; the decoded command must be equal.
+func (r *Runner) Run(conn net.Conn) []Result {
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+
+	tr := tunl.NewStreamTransport(conn, nil)
+	var results []Result
+	for _, c := range Cases() {
+		err := r.run(conn, tr, c, timeout)
+		results = append(results, Result{Case: c.Name, Err: err})
+		if err != nil && !errors.Is(err, ErrorCommandChanged) && !errors.Is(err, ErrorGoldenMismatch) {
+			break
+		}
+	}
+
+	return results
+}
+
+func (r *Runner) run(conn net.Conn, tr tunl.Transport, c Case, timeout time.Duration) error {
+	frame, err := c.Golden()
+	if err != nil {
+		return err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	if _, err = conn.Write(frame); err != nil {
+		return err
+	}
+
+	return expect(tr, c)
+}
+
+// Echo is the reference peer for Runner: it sends back every command it
+// receives until the connection is closed.
+func Echo(conn net.Conn) {
+	t := tunl.NewTunlConn(conn)
+	t.SetOnCommand(func(cmd *commands.Transfer) {
+		t.Send(cmd.Message())
+	})
+	t.HandleConnection()
+}
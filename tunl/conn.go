@@ -1,26 +1,41 @@
 package tunl
 
 import (
-	"encoding/binary"
 	"errors"
 	"github.com/black40x/tunl-core/commands"
+	"google.golang.org/protobuf/encoding/protowire"
 	"google.golang.org/protobuf/proto"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const prefixSize = 4
-
 const ReaderSize = 1 << 20
 
+const closeLinger = 2 * time.Second
+
 const (
 	ErrorServerFull int32 = 2000 + iota
 	ErrorUnauthorized
 	ErrorSessionExpired
 	ErrorClientResponse
 	ErrorServerRequest
+	ErrorProtocol
+	ErrorRateLimited
+	ErrorInternal
+	ErrorTunnelOffline
+)
+
+// Upstream errors are set in HttpResponse.error_code by the client when the
+// local service could not be reached or answered badly.
+const (
+	ErrorUpstreamRefused int32 = 3000 + iota
+	ErrorUpstreamTimeout
+	ErrorUpstreamTLS
+	ErrorUpstreamDNS
+	ErrorUpstreamBodyTooLarge
 )
 
 var ErrorConnectionClosed = errors.New("connection closed")
@@ -29,84 +44,265 @@ type CommandCallback func(cmd *commands.Transfer)
 type DisconnectCallback func()
 type ErrorCallback func(err error)
 
+type ConnState int32
+
+const (
+	StateConnecting ConnState = iota
+	StateOpen
+	StateDraining
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateConnecting:
+		return "connecting"
+	case StateOpen:
+		return "open"
+	case StateDraining:
+		return "draining"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
 type TunlConn struct {
-	ID             string
-	Conn           net.Conn
+	ID          string
+	Conn        net.Conn
+	ConnectedAt time.Time
+	// Deprecated: use Expiry and SetExpireAt. The field is only read when
+	// SetExpireAt was never called, and must be set before HandleExpire
+	// starts.
+	ExpireAt time.Time
+	// Deprecated: use Closed, which is safe to call from any goroutine. The
+	// field is set once when the connection closes.
+	IsClosed       bool
+	state          atomic.Int32
+	expireAt       atomic.Int64
+	cbMu           sync.RWMutex
 	onDisconnected DisconnectCallback
 	onCommand      CommandCallback
 	onError        ErrorCallback
-	ExpireAt       time.Time
-	ConnectedAt    time.Time
-	mu             sync.Mutex
-	IsClosed       bool
+	clock          Clock
+	transport      Transport
+	writer         *frameWriter
+	reuseTransfer  bool
+	compressor     atomic.Pointer[compressorRef]
+	compressMin    int
+	filter         compressionFilter
+	sealer         atomic.Pointer[Sealer]
+	sealMu         sync.Mutex
+	maxFrameSize   int
+	dbuf           *[]byte
+	closeOnce      sync.Once
+	disconnectOnce sync.Once
 }
 
 func NewTunlConn(conn net.Conn) *TunlConn {
-	return &TunlConn{
-		Conn:        conn,
-		ConnectedAt: time.Now(),
-		IsClosed:    false,
+	return NewTunlConnConfig(conn, nil)
+}
+
+func NewTunlConnConfig(conn net.Conn, cfg *Config) *TunlConn {
+	var tr Transport
+	if conn != nil {
+		tr = NewStreamTransport(conn, cfg)
+	}
+
+	t := NewTunlConnTransport(tr, cfg)
+	t.Conn = conn
+
+	return t
+}
+
+func NewTunlConnTransport(tr Transport, cfg *Config) *TunlConn {
+	cfg = cfg.withDefaults()
+	t := &TunlConn{
+		ConnectedAt:   cfg.Clock.Now(),
+		clock:         cfg.Clock,
+		transport:     tr,
+		reuseTransfer: cfg.ReuseTransfer,
+		compressMin:   cfg.CompressMinSize,
+		maxFrameSize:  cfg.MaxFrameSize,
+	}
+	t.writer = newFrameWriter(tr, cfg, t.handleWriteError)
+	if tr != nil {
+		go t.writer.run()
+	}
+
+	return t
+}
+
+func (t *TunlConn) Transport() Transport {
+	return t.transport
+}
+
+type compressorRef struct {
+	Compressor
+}
+
+// SetCompression switches frame compression on once both sides agreed on
+// a compressor during the handshake. An empty name switches it off.
+func (t *TunlConn) SetCompression(name string) error {
+	if name == "" {
+		t.compressor.Store(nil)
+		return nil
+	}
+
+	c := GetCompressor(name)
+	if c == nil {
+		return ErrorUnknownCompression
+	}
+	t.compressor.Store(&compressorRef{c})
+
+	return nil
+}
+
+func (t *TunlConn) Compression() string {
+	if c := t.getCompressor(); c != nil {
+		return c.Name()
+	}
+	return ""
+}
+
+func (t *TunlConn) getCompressor() Compressor {
+	if ref := t.compressor.Load(); ref != nil {
+		return ref.Compressor
+	}
+	return nil
+}
+
+// SetSealer enables end-to-end encryption of request and response headers
+// and body chunks. Incoming messages of those types must then be sealed.
+func (t *TunlConn) SetSealer(s *Sealer) {
+	t.sealer.Store(s)
+}
+
+// EndStream releases the state kept for a stream that ends without an EOF
+// chunk, such as the response to a HEAD request.
+func (t *TunlConn) EndStream(uuid string) {
+	t.filter.end(uuid)
+	if s := t.sealer.Load(); s != nil {
+		s.EndStream(uuid)
 	}
 }
 
 func (t *TunlConn) SetOnDisconnected(c DisconnectCallback) {
+	t.cbMu.Lock()
+	defer t.cbMu.Unlock()
 	t.onDisconnected = c
 }
 
 func (t *TunlConn) SetOnCommand(c CommandCallback) {
+	t.cbMu.Lock()
+	defer t.cbMu.Unlock()
 	t.onCommand = c
 }
 
 func (t *TunlConn) SetOnError(c ErrorCallback) {
+	t.cbMu.Lock()
+	defer t.cbMu.Unlock()
 	t.onError = c
 }
 
 func (t *TunlConn) handleError(err error) {
-	if t.onError != nil {
-		t.onError(err)
+	t.cbMu.RLock()
+	c := t.onError
+	t.cbMu.RUnlock()
+	if c != nil {
+		c(err)
 	}
 }
 
+func (t *TunlConn) handleWriteError(err error) {
+	if !t.Closed() {
+		t.handleError(err)
+	}
+	t.Close()
+}
+
 func (t *TunlConn) handleCommand(trans *commands.Transfer) {
-	if t.onCommand != nil {
-		t.onCommand(trans)
+	t.cbMu.RLock()
+	c := t.onCommand
+	t.cbMu.RUnlock()
+	if c != nil {
+		c(trans)
 	}
 }
 
 func (t *TunlConn) handleDisconnected() {
-	if t.onDisconnected != nil {
-		t.onDisconnected()
-	}
+	t.disconnectOnce.Do(func() {
+		t.cbMu.RLock()
+		c := t.onDisconnected
+		t.cbMu.RUnlock()
+		if c != nil {
+			c()
+		}
+	})
+}
+
+func (t *TunlConn) State() ConnState {
+	return ConnState(t.state.Load())
+}
+
+func (t *TunlConn) Closed() bool {
+	return t.State() == StateClosed
+}
+
+func (t *TunlConn) IsWritable() bool {
+	s := t.State()
+	return s == StateConnecting || s == StateOpen
+}
+
+// Drain stops accepting new outgoing frames while the connection keeps
+// reading, so that in-flight commands can still be delivered.
+func (t *TunlConn) Drain() {
+	t.state.CompareAndSwap(int32(StateOpen), int32(StateDraining))
+	t.state.CompareAndSwap(int32(StateConnecting), int32(StateDraining))
 }
 
 func (t *TunlConn) HandleExpire() {
 	for {
-		if time.Now().Unix() >= t.ExpireAt.Unix() {
-			t.Send(&commands.Error{
-				Code:    ErrorSessionExpired,
-				Message: "session expired",
-			})
-			time.Sleep(time.Second)
+		<-t.clock.After(time.Second)
+		if t.Closed() {
+			return
+		}
+		expireAt := t.Expiry()
+		if !expireAt.IsZero() && t.clock.Now().Unix() >= expireAt.Unix() {
+			t.Send(NewError(ErrorSessionExpired, "session expired").Proto())
+			t.Drain()
+			<-t.clock.After(time.Second)
 			t.Close()
-			break
+			return
 		}
-		time.Sleep(time.Second)
 	}
 }
 
 func (t *TunlConn) HandleConnection() {
-	defer t.Conn.Close()
+	defer t.Close()
+	defer t.releaseBuffers()
+	t.state.CompareAndSwap(int32(StateConnecting), int32(StateOpen))
+
+	trans := &commands.Transfer{}
 	for {
-		trans := &commands.Transfer{}
-		data, err := t.Read()
-		if err != nil || t.Conn == nil || t.IsClosed {
-			if err == io.EOF {
-				t.handleDisconnected()
-				break
+		data, err := t.ReadFrame()
+		if err != nil {
+			if err != io.EOF && !t.Closed() {
+				t.handleError(err)
 			}
-			continue
+			t.handleDisconnected()
+			return
+		}
+
+		if t.reuseTransfer {
+			resetTransfer(trans, data)
+		} else {
+			trans = &commands.Transfer{}
+		}
+		err = proto.UnmarshalOptions{Merge: true}.Unmarshal(data, trans)
+		if s := t.sealer.Load(); err == nil && s != nil {
+			err = s.openTransfer(trans)
 		}
-		err = proto.Unmarshal(data, trans)
 		if err != nil {
 			t.handleError(err)
 		} else {
@@ -115,99 +311,270 @@ func (t *TunlConn) HandleConnection() {
 	}
 }
 
-func (t *TunlConn) Read() ([]byte, error) {
-	if t.Conn == nil {
+// resetTransfer clears trans but keeps its command message when data holds
+// only that same command, so decoding a frame of the same type reuses the
+// allocation. Any other frame gets a fully reset Transfer.
+func resetTransfer(trans *commands.Transfer, data []byte) {
+	var num protowire.Number
+	var keep bool
+	switch c := trans.Command.(type) {
+	case *commands.Transfer_BodyChunk:
+		num, keep = transferBodyChunk, c.BodyChunk != nil
+	case *commands.Transfer_HttpRequest:
+		num, keep = transferHttpRequest, c.HttpRequest != nil
+	case *commands.Transfer_HttpResponse:
+		num, keep = transferHttpResponse, c.HttpResponse != nil
+	}
+	if keep {
+		keep = onlyField(data, num)
+	}
+	if !keep {
+		trans.Reset()
+		return
+	}
+	switch c := trans.Command.(type) {
+	case *commands.Transfer_BodyChunk:
+		c.BodyChunk.Reset()
+	case *commands.Transfer_HttpRequest:
+		c.HttpRequest.Reset()
+	case *commands.Transfer_HttpResponse:
+		c.HttpResponse.Reset()
+	}
+	trans.ProtoReflect().SetUnknown(nil)
+}
+
+// Field numbers of the Transfer commands that resetTransfer reuses.
+const (
+	transferHttpRequest  protowire.Number = 4
+	transferHttpResponse protowire.Number = 5
+	transferBodyChunk    protowire.Number = 6
+)
+
+// onlyField reports whether data is a non-empty message whose top-level
+// fields are all num.
+func onlyField(data []byte, num protowire.Number) bool {
+	if len(data) == 0 {
+		return false
+	}
+	for len(data) > 0 {
+		n, typ, l := protowire.ConsumeTag(data)
+		if l < 0 || n != num {
+			return false
+		}
+		data = data[l:]
+		l = protowire.ConsumeFieldValue(n, typ, data)
+		if l < 0 {
+			return false
+		}
+		data = data[l:]
+	}
+	return true
+}
+
+// ReadFrame returns the payload of the next frame. The returned slice is
+// only valid until the next call to ReadFrame or Read.
+func (t *TunlConn) ReadFrame() ([]byte, error) {
+	if t.transport == nil || t.Closed() {
 		return nil, ErrorConnectionClosed
 	}
 
-	prefix := make([]byte, prefixSize)
-	_, err := io.ReadFull(t.Conn, prefix)
+	f, err := t.transport.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+	if f.Compressed {
+		return t.decompress(f.Payload)
+	}
+
+	return f.Payload, nil
+}
 
+func (t *TunlConn) decompress(data []byte) ([]byte, error) {
+	c := t.getCompressor()
+	if c == nil {
+		return nil, ErrorUnknownCompression
+	}
+
+	if t.dbuf == nil {
+		t.dbuf = getBuffer(len(data) * 4)
+	}
+	out, err := c.Decompress((*t.dbuf)[:0], data, t.maxFrameSize)
+	if cap(out) > cap(*t.dbuf) {
+		putBuffer(t.dbuf)
+		t.dbuf = &out
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	totalDataLength := binary.BigEndian.Uint32(prefix[:])
+	return out, nil
+}
 
-	data := make([]byte, totalDataLength-prefixSize)
+func (t *TunlConn) releaseBuffers() {
+	if r, ok := t.transport.(interface{ release() }); ok {
+		r.release()
+	}
+	if t.dbuf != nil {
+		putBuffer(t.dbuf)
+		t.dbuf = nil
+	}
+}
 
-	_, err = io.ReadFull(t.Conn, data)
+func (t *TunlConn) Read() ([]byte, error) {
+	data, err := t.ReadFrame()
 	if err != nil {
 		return nil, err
 	}
 
-	return data, nil
+	return append([]byte(nil), data...), nil
 }
 
-func (t *TunlConn) makePacket(data []byte) []byte {
-	buf := make([]byte, prefixSize+len(data))
-	binary.BigEndian.PutUint32(buf[:prefixSize], uint32(prefixSize+len(data)))
-	copy(buf[prefixSize:], data[:])
+func (t *TunlConn) writeFrame(b outFrame, prio priority, key string) (n int, err error) {
+	if t.transport == nil || !t.IsWritable() {
+		putBuffer(b.buf)
+		return 0, ErrorConnectionClosed
+	}
+
+	n, err = t.writer.enqueue(b, prio, key)
+	if err == ErrorSlowConsumer {
+		t.handleError(err)
+		t.Close()
+	}
 
-	return buf
+	return n, err
 }
 
+// Write queues data as a single frame. Raw frames are scheduled as bulk data
+// and keep their order relative to each other only.
 func (t *TunlConn) Write(data []byte) (n int, err error) {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+	bp := getBuffer(len(data))
+	*bp = append(*bp, data...)
+
+	return t.writeFrame(outFrame{buf: bp}, priorityData, "")
+}
 
-	if t.Conn == nil {
-		return 0, errors.New("connection closed")
+// Flush blocks until every frame queued before the call has been written to
+// the connection.
+func (t *TunlConn) Flush() error {
+	if t.transport == nil || t.Closed() {
+		return ErrorConnectionClosed
 	}
 
-	return t.Conn.Write(t.makePacket(data))
+	return t.writer.Flush()
+}
+
+func (t *TunlConn) Stats() Stats {
+	if t.writer == nil {
+		return Stats{}
+	}
+
+	return t.writer.stats()
 }
 
 func (t *TunlConn) Send(m proto.Message) (n int, err error) {
-	trans := &commands.Transfer{}
-	switch m.(type) {
-	case *commands.ServerHeader:
-		trans.Command = &commands.Transfer_ServerHeader{
-			ServerHeader: m.(*commands.ServerHeader),
-		}
-	case *commands.ServerConnect:
-		trans.Command = &commands.Transfer_ServerConnect{
-			ServerConnect: m.(*commands.ServerConnect),
-		}
-	case *commands.ClientConnect:
-		trans.Command = &commands.Transfer_ClientConnect{
-			ClientConnect: m.(*commands.ClientConnect),
-		}
-	case *commands.HttpRequest:
-		trans.Command = &commands.Transfer_HttpRequest{
-			HttpRequest: m.(*commands.HttpRequest),
-		}
-	case *commands.HttpResponse:
-		trans.Command = &commands.Transfer_HttpResponse{
-			HttpResponse: m.(*commands.HttpResponse),
+	if s := t.sealer.Load(); s != nil {
+		switch m.(type) {
+		case *commands.HttpRequest, *commands.HttpResponse, *commands.BodyChunk:
+			return t.sendSealed(s, m)
 		}
+	}
+
+	return t.send(m)
+}
+
+// sendSealed numbers and queues m under one lock, so messages reach the
+// queue in the order they were sealed. A message that is never queued gives
+// its number back, since the peer would otherwise wait for it forever.
+func (t *TunlConn) sendSealed(s *Sealer, m proto.Message) (int, error) {
+	t.sealMu.Lock()
+	defer t.sealMu.Unlock()
+
+	sealed, err := s.sealMessage(m)
+	if err != nil {
+		return 0, err
+	}
+	n, err := t.send(sealed)
+	if err != nil {
+		s.release(sealed)
+	}
+
+	return n, err
+}
+
+func (t *TunlConn) send(m proto.Message) (n int, err error) {
+	trans := commands.NewTransfer(m)
+	prio, key := priorityControl, ""
+	switch m := m.(type) {
+	case *commands.HttpRequest, *commands.HttpResponse:
+		prio = priorityHeader
 	case *commands.BodyChunk:
-		trans.Command = &commands.Transfer_BodyChunk{
-			BodyChunk: m.(*commands.BodyChunk),
-		}
-	case *commands.Error:
-		trans.Command = &commands.Transfer_Error{
-			Error: m.(*commands.Error),
-		}
+		prio, key = priorityData, m.GetUuid()
 	}
 
-	buf, err := proto.Marshal(trans)
+	bp := getBuffer(proto.Size(trans))
+	buf, err := proto.MarshalOptions{}.MarshalAppend(*bp, trans)
 	if err != nil {
+		putBuffer(bp)
 		return 0, err
 	}
+	*bp = buf
 
-	return t.Write(buf)
+	frame := outFrame{buf: bp}
+	if c := t.getCompressor(); c != nil && t.filter.allow(m) && len(buf) >= t.compressMin {
+		frame = t.compress(c, frame)
+	}
+
+	return t.writeFrame(frame, prio, key)
+}
+
+// compress returns a compressed copy of the frame, or the frame itself when
+// compression does not make it any smaller.
+func (t *TunlConn) compress(c Compressor, frame outFrame) outFrame {
+	cp := getBuffer(len(*frame.buf))
+	out, err := c.Compress(*cp, *frame.buf)
+	if err != nil || len(out) >= len(*frame.buf) {
+		putBuffer(cp)
+		return frame
+	}
+
+	putBuffer(frame.buf)
+	*cp = out
+
+	return outFrame{buf: cp, compressed: true}
+}
+
+// Expiry returns the time set with SetExpireAt, falling back to the
+// deprecated ExpireAt field.
+func (t *TunlConn) Expiry() time.Time {
+	e := t.expireAt.Load()
+	if e == 0 {
+		return t.ExpireAt
+	}
+	return time.Unix(0, e)
 }
 
 func (t *TunlConn) SetExpireAt(e time.Time) {
-	t.ExpireAt = e
+	if e.IsZero() {
+		t.expireAt.Store(0)
+		return
+	}
+	t.expireAt.Store(e.UnixNano())
 }
 
 func (t *TunlConn) Close() error {
-	t.mu.Lock()
-	defer t.mu.Unlock()
+	if t == nil {
+		return ErrorConnectionClosed
+	}
 
-	t.IsClosed = true
+	var err error
+	t.closeOnce.Do(func() {
+		t.state.Store(int32(StateClosed))
+		t.IsClosed = true
+		if t.transport != nil {
+			t.writer.close(closeLinger)
+			err = t.transport.Close()
+		}
+	})
 
-	return t.Conn.Close()
+	return err
 }
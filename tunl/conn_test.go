@@ -0,0 +1,188 @@
+package tunl_test
+
+import (
+	"github.com/black40x/tunl-core/commands"
+	"github.com/black40x/tunl-core/tunl"
+	"github.com/black40x/tunl-core/tunl/tunltest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCloseNil(t *testing.T) {
+	var c *tunl.TunlConn
+	if err := c.Close(); err != tunl.ErrorConnectionClosed {
+		t.Fatalf("Close on nil: %v", err)
+	}
+}
+
+func TestCloseIdempotent(t *testing.T) {
+	client, server := tunltest.Pair(nil)
+	defer server.Close()
+
+	if err := client.Close(); err != nil {
+		t.Fatalf("first Close: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		client.Close()
+	}
+	if !client.Closed() {
+		t.Fatal("connection not closed")
+	}
+	if _, err := client.Send(&commands.BodyChunk{Uuid: "a"}); err != tunl.ErrorConnectionClosed {
+		t.Fatalf("Send after Close: %v", err)
+	}
+}
+
+func TestConcurrentSendClose(t *testing.T) {
+	clock := tunltest.NewFakeClock(time.Unix(1000, 0))
+	cfg := tunl.DefaultConfig()
+	cfg.Clock = clock
+	client, server := tunltest.Pair(cfg)
+
+	server.SetOnCommand(func(cmd *commands.Transfer) {})
+	client.SetExpireAt(clock.Now())
+
+	var handlers sync.WaitGroup
+	handlers.Add(3)
+	go func() {
+		defer handlers.Done()
+		server.HandleConnection()
+	}()
+	go func() {
+		defer handlers.Done()
+		client.HandleConnection()
+	}()
+	go func() {
+		defer handlers.Done()
+		client.HandleExpire()
+	}()
+
+	var senders sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		senders.Add(1)
+		go func(i int) {
+			defer senders.Done()
+			for j := 0; j < 100; j++ {
+				client.Send(&commands.BodyChunk{Uuid: string(rune('a' + i)), Body: []byte("data")})
+				server.Send(&commands.BodyChunk{Uuid: string(rune('a' + i)), Body: []byte("data")})
+			}
+		}(i)
+	}
+
+	for i := 0; i < 4; i++ {
+		senders.Add(1)
+		go func() {
+			defer senders.Done()
+			time.Sleep(time.Millisecond)
+			client.Close()
+			server.Close()
+		}()
+	}
+	senders.Wait()
+
+	done := make(chan struct{})
+	go func() {
+		handlers.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			if !client.Closed() || !server.Closed() {
+				t.Fatal("connections not closed")
+			}
+			return
+		case <-time.After(time.Millisecond):
+			clock.Advance(time.Second)
+		}
+	}
+}
+
+func TestHandleExpire(t *testing.T) {
+	clock := tunltest.NewFakeClock(time.Unix(1000, 0))
+	cfg := tunl.DefaultConfig()
+	cfg.Clock = clock
+	c, peer := tunltest.NewPeer(cfg)
+	defer peer.Close()
+
+	c.SetExpireAt(clock.Now().Add(time.Second))
+	done := make(chan struct{})
+	go func() {
+		c.HandleExpire()
+		close(done)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+
+	peer.ExpectError(t, tunl.ErrorSessionExpired)
+	if c.IsWritable() {
+		t.Fatal("connection still writable after expiry")
+	}
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	<-done
+	if !c.Closed() {
+		t.Fatal("connection not closed after expiry")
+	}
+	peer.ExpectClosed(t)
+}
+
+func TestDeprecatedFields(t *testing.T) {
+	clock := tunltest.NewFakeClock(time.Unix(1000, 0))
+	cfg := tunl.DefaultConfig()
+	cfg.Clock = clock
+	c, peer := tunltest.NewPeer(cfg)
+	defer peer.Close()
+
+	c.ExpireAt = clock.Now().Add(time.Second)
+	if !c.Expiry().Equal(c.ExpireAt) {
+		t.Fatalf("Expiry() = %v, want the ExpireAt field", c.Expiry())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		c.HandleExpire()
+		close(done)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	peer.ExpectError(t, tunl.ErrorSessionExpired)
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	<-done
+
+	if !c.IsClosed || !c.Closed() {
+		t.Fatal("IsClosed field not set after expiry")
+	}
+}
+
+func TestReuseTransferSwitchesCommand(t *testing.T) {
+	cfg := tunl.DefaultConfig()
+	cfg.ReuseTransfer = true
+	conn, peer := tunltest.NewPeer(cfg)
+	defer peer.Close()
+
+	rec := tunltest.NewRecorder()
+	conn.SetOnCommand(rec.Record)
+	go conn.HandleConnection()
+
+	peer.Send(&commands.BodyChunk{Uuid: "a", Body: []byte("x")})
+	peer.WriteFrame(nil)
+	peer.Send(&commands.BodyChunk{Uuid: "a", Body: []byte("y")})
+	peer.Send(&commands.HttpRequest{Uuid: "b", Method: "GET"})
+	peer.Send(&commands.BodyChunk{Uuid: "b", Eof: true})
+
+	rec.Expect(t, &commands.BodyChunk{Uuid: "a", Body: []byte("x")})
+	if got := rec.Next(t); got.Command != nil {
+		t.Fatalf("empty frame decoded as %v", got)
+	}
+	rec.Expect(t,
+		&commands.BodyChunk{Uuid: "a", Body: []byte("y")},
+		&commands.HttpRequest{Uuid: "b", Method: "GET"},
+		&commands.BodyChunk{Uuid: "b", Eof: true},
+	)
+}
@@ -0,0 +1,437 @@
+package tunl
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrorUnsupportedHash = errors.New("unsupported password hash")
+
+const credentialCacheSize = 10000
+
+// Argon2 parameters used by HashPasswordArgon2.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 << 10
+	argon2Threads = 4
+	argon2KeyLen  = 32
+)
+
+// Limits on the argon2 parameters accepted from a hash, so that one bad
+// line in a password file cannot make Verify allocate without bound.
+const (
+	argon2MaxTime    = 16
+	argon2MaxMemory  = 256 << 10
+	argon2MaxThreads = 16
+	argon2MaxKeyLen  = 128
+)
+
+// CredentialStore checks user passwords against hashes only. It accepts
+// bcrypt, argon2id and argon2i in PHC format, and the Apache $apr1$ and
+// {SHA} schemes found in htpasswd files.
+//
+// Verifying bcrypt and argon2 hashes is slow on purpose. Setting CacheTTL
+// remembers successful checks for that long, keyed by an HMAC of the user
+// and password. The HMAC key lives next to the cache, so anyone able to read
+// process memory can then test guesses at SHA-256 speed instead of at the
+// cost of the hash; the cache is off by default.
+//
+// The zero value is an empty store that uses the system clock.
+type CredentialStore struct {
+	CacheTTL time.Duration
+	Clock    Clock
+	mu       sync.RWMutex
+	users    map[string]string
+	keyOnce  sync.Once
+	cacheKey []byte
+	cache    map[[32]byte]time.Time
+}
+
+func NewCredentialStore() *CredentialStore {
+	return &CredentialStore{
+		Clock: SystemClock,
+		users: map[string]string{},
+		cache: map[[32]byte]time.Time{},
+	}
+}
+
+// LoadHtpasswd returns a store with the users of an htpasswd file.
+func LoadHtpasswd(path string) (*CredentialStore, error) {
+	s := NewCredentialStore()
+	if err := s.LoadHtpasswd(path); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// LoadHtpasswd replaces the users of the store with those of an htpasswd
+// file, which makes it suitable for reloading.
+func (s *CredentialStore) LoadHtpasswd(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return s.ReadHtpasswd(f)
+}
+
+// ReadHtpasswd replaces the users of the store with the user:hash lines of
+// r. Blank lines and lines starting with # are skipped.
+func (s *CredentialStore) ReadHtpasswd(r io.Reader) error {
+	users := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("htpasswd line %d: missing user or hash", n)
+		}
+		if !supportedHash(hash) {
+			return fmt.Errorf("htpasswd line %d: %w", n, ErrorUnsupportedHash)
+		}
+		users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = users
+	s.resetCache()
+
+	return nil
+}
+
+// Add sets the password hash of user.
+func (s *CredentialStore) Add(user, hash string) error {
+	if !supportedHash(hash) {
+		return ErrorUnsupportedHash
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.init()
+	s.users[user] = hash
+	s.resetCache()
+
+	return nil
+}
+
+// SetPassword hashes password with bcrypt and stores it for user.
+func (s *CredentialStore) SetPassword(user, password string) error {
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return s.Add(user, hash)
+}
+
+func (s *CredentialStore) Remove(user string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.users, user)
+	s.resetCache()
+}
+
+func (s *CredentialStore) Users() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]string, 0, len(s.users))
+	for u := range s.users {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+
+	return users
+}
+
+// init creates the maps of a zero store. s.mu must be held for writing.
+func (s *CredentialStore) init() {
+	if s.users == nil {
+		s.users = map[string]string{}
+	}
+	if s.cache == nil {
+		s.resetCache()
+	}
+}
+
+func (s *CredentialStore) now() time.Time {
+	if s.Clock == nil {
+		return SystemClock.Now()
+	}
+	return s.Clock.Now()
+}
+
+func (s *CredentialStore) resetCache() {
+	s.cache = map[[32]byte]time.Time{}
+}
+
+// cacheEntry returns the cache key of the credentials, or false when caching
+// is off or no HMAC key could be generated.
+func (s *CredentialStore) cacheEntry(user, password string) ([32]byte, bool) {
+	var k [32]byte
+	if s.CacheTTL <= 0 {
+		return k, false
+	}
+	s.keyOnce.Do(func() {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err == nil {
+			s.cacheKey = key
+		}
+	})
+	if s.cacheKey == nil {
+		return k, false
+	}
+
+	m := hmac.New(sha256.New, s.cacheKey)
+	m.Write([]byte(user))
+	m.Write([]byte{0})
+	m.Write([]byte(password))
+	copy(k[:], m.Sum(nil))
+
+	return k, true
+}
+
+var (
+	dummyHashOnce sync.Once
+	dummyHash     string
+)
+
+// Verify reports whether password is correct for user. Unknown users cost
+// as much as known ones, so timing does not reveal which users exist.
+func (s *CredentialStore) Verify(user, password string) bool {
+	key, caching := s.cacheEntry(user, password)
+
+	s.mu.RLock()
+	hash, ok := s.users[user]
+	expires, cached := s.cache[key]
+	s.mu.RUnlock()
+
+	if !ok {
+		dummyHashOnce.Do(func() {
+			dummyHash, _ = HashPassword("")
+		})
+		verifyHash(dummyHash, password)
+		return false
+	}
+	if caching && cached && s.now().Before(expires) {
+		return true
+	}
+	if !verifyHash(hash, password) {
+		return false
+	}
+
+	if caching {
+		s.mu.Lock()
+		if s.users[user] == hash {
+			s.init()
+			if len(s.cache) >= credentialCacheSize {
+				s.resetCache()
+			}
+			s.cache[key] = s.now().Add(s.CacheTTL)
+		}
+		s.mu.Unlock()
+	}
+
+	return true
+}
+
+// BasicAuthenticator protects a public URL with the users of the store.
+func (s *CredentialStore) BasicAuthenticator(realm string) *BasicAuthenticator {
+	return &BasicAuthenticator{Realm: realm, Verify: s.Verify}
+}
+
+// HashPassword returns a bcrypt hash of password.
+func HashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+
+	return string(hash), nil
+}
+
+// HashPasswordArgon2 returns an argon2id hash of password in PHC format.
+func HashPasswordArgon2(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func supportedHash(hash string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err == nil
+	case strings.HasPrefix(hash, "$argon2"):
+		_, ok := parseArgon2(hash)
+		return ok
+	case strings.HasPrefix(hash, "$apr1$"):
+		return strings.Count(hash, "$") == 3
+	case strings.HasPrefix(hash, "{SHA}"):
+		b, err := base64.StdEncoding.DecodeString(hash[5:])
+		return err == nil && len(b) == sha1.Size
+	}
+
+	return false
+}
+
+func verifyHash(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "$argon2"):
+		a, ok := parseArgon2(hash)
+		return ok && subtle.ConstantTimeCompare(a.derive(password), a.key) == 1
+	case strings.HasPrefix(hash, "$apr1$"):
+		salt := strings.SplitN(hash[len("$apr1$"):], "$", 2)[0]
+		return subtle.ConstantTimeCompare([]byte(apr1(password, salt)), []byte(hash)) == 1
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		want := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(want), []byte(hash)) == 1
+	}
+
+	return false
+}
+
+type argon2Hash struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+// parseArgon2 reads $argon2id$v=19$m=65536,t=3,p=4$salt$key.
+func parseArgon2(hash string) (*argon2Hash, bool) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || (parts[1] != "argon2id" && parts[1] != "argon2i") {
+		return nil, false
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, false
+	}
+
+	a := &argon2Hash{variant: parts[1]}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &a.memory, &a.time, &a.threads); err != nil ||
+		a.memory == 0 || a.memory > argon2MaxMemory || a.time == 0 || a.time > argon2MaxTime ||
+		a.threads == 0 || a.threads > argon2MaxThreads {
+		return nil, false
+	}
+
+	var err error
+	if a.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, false
+	}
+	if a.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(a.key) == 0 || len(a.key) > argon2MaxKeyLen {
+		return nil, false
+	}
+
+	return a, true
+}
+
+func (a *argon2Hash) derive(password string) []byte {
+	if a.variant == "argon2i" {
+		return argon2.Key([]byte(password), a.salt, a.time, a.memory, a.threads, uint32(len(a.key)))
+	}
+	return argon2.IDKey([]byte(password), a.salt, a.time, a.memory, a.threads, uint32(len(a.key)))
+}
+
+const apr1Alphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// apr1 is the Apache variant of the MD5 crypt scheme, the htpasswd default.
+func apr1(password, salt string) string {
+	const magic = "$apr1$"
+	if len(salt) > 8 {
+		salt = salt[:8]
+	}
+	pw := []byte(password)
+
+	alt := md5.Sum([]byte(password + salt + password))
+	ctx := md5.New()
+	ctx.Write([]byte(password + magic + salt))
+	for i := len(pw); i > 0; i -= 16 {
+		n := i
+		if n > 16 {
+			n = 16
+		}
+		ctx.Write(alt[:n])
+	}
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			ctx.Write([]byte{0})
+		} else {
+			ctx.Write(pw[:1])
+		}
+	}
+	final := ctx.Sum(nil)
+
+	for i := 0; i < 1000; i++ {
+		c := md5.New()
+		if i&1 != 0 {
+			c.Write(pw)
+		} else {
+			c.Write(final)
+		}
+		if i%3 != 0 {
+			c.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			c.Write(pw)
+		}
+		if i&1 != 0 {
+			c.Write(final)
+		} else {
+			c.Write(pw)
+		}
+		final = c.Sum(nil)
+	}
+
+	out := []byte(magic + salt + "$")
+	to64 := func(v uint32, n int) {
+		for ; n > 0; n-- {
+			out = append(out, apr1Alphabet[v&0x3f])
+			v >>= 6
+		}
+	}
+	for _, g := range [][3]int{{0, 6, 12}, {1, 7, 13}, {2, 8, 14}, {3, 9, 15}, {4, 10, 5}} {
+		to64(uint32(final[g[0]])<<16|uint32(final[g[1]])<<8|uint32(final[g[2]]), 4)
+	}
+	to64(uint32(final[11]), 2)
+
+	return string(out)
+}
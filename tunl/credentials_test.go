@@ -0,0 +1,143 @@
+package tunl_test
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"github.com/black40x/tunl-core/tunl"
+	"github.com/black40x/tunl-core/tunl/tunltest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func shaHash(password string) string {
+	sum := sha1.Sum([]byte(password))
+	return "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestCredentialStoreHashes(t *testing.T) {
+	bcrypt, err := tunl.HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon, err := tunl.HashPasswordArgon2("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := tunl.NewCredentialStore()
+	hashes := map[string]string{
+		"apr1":   "$apr1$r31abcde$SZEN.U5sWGGNcv9YsUrqI.",
+		"sha":    shaHash("secret"),
+		"bcrypt": bcrypt,
+		"argon2": argon,
+	}
+	for user, hash := range hashes {
+		if err = s.Add(user, hash); err != nil {
+			t.Fatalf("%s: %v", user, err)
+		}
+	}
+
+	for user := range hashes {
+		if !s.Verify(user, "secret") {
+			t.Errorf("%s: password rejected", user)
+		}
+		if s.Verify(user, "Secret") {
+			t.Errorf("%s: wrong password accepted", user)
+		}
+	}
+	if s.Verify("nobody", "secret") {
+		t.Error("unknown user accepted")
+	}
+}
+
+func TestCredentialStoreRejects(t *testing.T) {
+	s := tunl.NewCredentialStore()
+	for _, hash := range []string{
+		"secret",
+		"$1$abc$def",
+		"{SHA}short",
+		"$argon2id$v=19$m=4294967295,t=1,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5",
+		"$argon2id$v=19$m=65536,t=1000000,p=1$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5",
+		"$argon2id$v=19$m=65536,t=1,p=200$c2FsdHNhbHQ$a2V5a2V5a2V5a2V5",
+	} {
+		if err := s.Add("u", hash); err != tunl.ErrorUnsupportedHash {
+			t.Errorf("Add(%q) = %v", hash, err)
+		}
+	}
+}
+
+func TestReadHtpasswd(t *testing.T) {
+	s := tunl.NewCredentialStore()
+	s.SetPassword("old", "pw")
+
+	file := "# users\n\nalice:$apr1$r31abcde$SZEN.U5sWGGNcv9YsUrqI.\n  bob:" + shaHash("pw") + "  \n"
+	if err := s.ReadHtpasswd(strings.NewReader(file)); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Users(); strings.Join(got, ",") != "alice,bob" {
+		t.Fatalf("Users() = %v", got)
+	}
+	if !s.Verify("alice", "secret") || !s.Verify("bob", "pw") || s.Verify("old", "pw") {
+		t.Fatal("store does not match the file")
+	}
+
+	err := s.ReadHtpasswd(strings.NewReader("alice:" + shaHash("x") + "\ncarol:plain\n"))
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("ReadHtpasswd() = %v", err)
+	}
+	if !s.Verify("alice", "secret") {
+		t.Fatal("failed load changed the store")
+	}
+}
+
+func TestCredentialStoreCache(t *testing.T) {
+	clock := tunltest.NewFakeClock(time.Unix(1000, 0))
+	s := tunl.NewCredentialStore()
+	s.CacheTTL = time.Minute
+	s.Clock = clock
+
+	if err := s.SetPassword("alice", "one"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Verify("alice", "one") || !s.Verify("alice", "one") {
+		t.Fatal("password rejected")
+	}
+
+	if err := s.SetPassword("alice", "two"); err != nil {
+		t.Fatal(err)
+	}
+	if s.Verify("alice", "one") {
+		t.Fatal("cached password survived a change")
+	}
+	s.Remove("alice")
+	if s.Verify("alice", "two") {
+		t.Fatal("removed user accepted")
+	}
+}
+
+func TestCredentialStoreZeroValue(t *testing.T) {
+	var s tunl.CredentialStore
+	s.CacheTTL = time.Minute
+
+	if s.Verify("alice", "one") {
+		t.Fatal("empty store accepted a user")
+	}
+	if err := s.Add("bob", shaHash("two")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetPassword("alice", "one"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if !s.Verify("alice", "one") || !s.Verify("bob", "two") {
+			t.Fatal("password rejected")
+		}
+	}
+
+	var removed tunl.CredentialStore
+	removed.Remove("alice")
+	if users := removed.Users(); len(users) != 0 {
+		t.Fatalf("users: %v", users)
+	}
+}
@@ -0,0 +1,439 @@
+package tunl
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrorProxyUnsupported = errors.New("unsupported proxy scheme")
+	ErrorProxyAuth        = errors.New("proxy authentication failed")
+)
+
+// Dialer opens control connections to a tunl server, going through an HTTP
+// CONNECT or SOCKS5 proxy when one is configured.
+type Dialer struct {
+	// Proxy returns the proxy to use for addr, or nil to connect directly.
+	// ProxyFromEnvironment is used when it is not set.
+	Proxy func(addr string) (*url.URL, error)
+	// Timeout limits connecting to the proxy and the proxy handshake.
+	Timeout time.Duration
+	// TLSConfig is used to connect to https:// proxies.
+	TLSConfig *tls.Config
+}
+
+func Dial(addr string) (net.Conn, error) {
+	return (&Dialer{}).DialContext(context.Background(), "tcp", addr)
+}
+
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	proxy := d.Proxy
+	if proxy == nil {
+		proxy = ProxyFromEnvironment
+	}
+
+	p, err := proxy(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	nd := &net.Dialer{}
+	if p == nil {
+		return nd.DialContext(ctx, network, addr)
+	}
+
+	switch strings.ToLower(p.Scheme) {
+	case "http", "https":
+		return d.dialConnect(ctx, nd, p, addr)
+	case "socks5", "socks5h":
+		return d.dialSocks5(ctx, nd, p, addr)
+	}
+
+	return nil, fmt.Errorf("%w: %s", ErrorProxyUnsupported, p.Scheme)
+}
+
+func proxyAddr(p *url.URL) string {
+	port := p.Port()
+	if port == "" {
+		switch strings.ToLower(p.Scheme) {
+		case "https":
+			port = "443"
+		case "socks5", "socks5h":
+			port = "1080"
+		default:
+			port = "80"
+		}
+	}
+	return net.JoinHostPort(p.Hostname(), port)
+}
+
+// watchContext applies the context deadline to conn for the duration of a
+// handshake and closes conn if the context is cancelled first. The returned
+// stop waits for the watcher to exit and reports the context error if conn
+// was closed because of it.
+func watchContext(ctx context.Context, conn net.Conn) func() error {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	done := make(chan struct{})
+	exited := make(chan error, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			exited <- ctx.Err()
+		case <-done:
+			exited <- nil
+		}
+	}()
+
+	return func() error {
+		close(done)
+		err := <-exited
+		conn.SetDeadline(time.Time{})
+		return err
+	}
+}
+
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (d *Dialer) dialConnect(ctx context.Context, nd *net.Dialer, p *url.URL, addr string) (net.Conn, error) {
+	conn, err := nd.DialContext(ctx, "tcp", proxyAddr(p))
+	if err != nil {
+		return nil, err
+	}
+	stop := watchContext(ctx, conn)
+
+	if strings.EqualFold(p.Scheme, "https") {
+		cfg := d.TLSConfig
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		cfg = cfg.Clone()
+		if cfg.ServerName == "" {
+			cfg.ServerName = p.Hostname()
+		}
+		tc := tls.Client(conn, cfg)
+		if err = tc.HandshakeContext(ctx); err != nil {
+			stop()
+			conn.Close()
+			return nil, err
+		}
+		conn = tc
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.User != nil {
+		pass, _ := p.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(p.User.Username() + ":" + pass))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+
+	br := bufio.NewReader(conn)
+	err = req.Write(conn)
+	var resp *http.Response
+	if err == nil {
+		resp, err = http.ReadResponse(br, req)
+	}
+	if serr := stop(); err == nil {
+		err = serr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// A successful CONNECT response has no body; the stream that follows
+	// belongs to the tunnel.
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusProxyAuthRequired:
+		conn.Close()
+		return nil, ErrorProxyAuth
+	default:
+		conn.Close()
+		return nil, fmt.Errorf("proxy connect: %s", resp.Status)
+	}
+
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+const (
+	socksVersion      = 0x05
+	socksNoAuth       = 0x00
+	socksUserPass     = 0x02
+	socksNoAcceptable = 0xff
+	socksConnect      = 0x01
+	socksIPv4         = 0x01
+	socksDomain       = 0x03
+	socksIPv6         = 0x04
+)
+
+var socksReplies = []string{
+	"succeeded",
+	"general server failure",
+	"connection not allowed by ruleset",
+	"network unreachable",
+	"host unreachable",
+	"connection refused",
+	"TTL expired",
+	"command not supported",
+	"address type not supported",
+}
+
+func (d *Dialer) dialSocks5(ctx context.Context, nd *net.Dialer, p *url.URL, addr string) (net.Conn, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 0xffff {
+		return nil, fmt.Errorf("invalid port: %s", portStr)
+	}
+
+	// socks5:// resolves the target locally, socks5h:// leaves it to the
+	// proxy.
+	if strings.EqualFold(p.Scheme, "socks5") && net.ParseIP(host) == nil {
+		ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		host = ips[0].String()
+	}
+
+	conn, err := nd.DialContext(ctx, "tcp", proxyAddr(p))
+	if err != nil {
+		return nil, err
+	}
+	stop := watchContext(ctx, conn)
+
+	err = socks5Handshake(conn, p.User, host, port)
+	if serr := stop(); err == nil {
+		err = serr
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+var errorSocksVersion = errors.New("socks5: unexpected protocol version")
+
+func socks5Handshake(conn net.Conn, user *url.Userinfo, host string, port int) error {
+	methods := []byte{socksNoAuth}
+	if user != nil {
+		methods = append(methods, socksUserPass)
+	}
+	if _, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return errorSocksVersion
+	}
+
+	switch reply[1] {
+	case socksNoAuth:
+	case socksUserPass:
+		if user == nil {
+			return ErrorProxyAuth
+		}
+		pass, _ := user.Password()
+		name := user.Username()
+		if len(name) > 255 || len(pass) > 255 {
+			return ErrorProxyAuth
+		}
+		msg := []byte{0x01, byte(len(name))}
+		msg = append(msg, name...)
+		msg = append(msg, byte(len(pass)))
+		msg = append(msg, pass...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply[:]); err != nil {
+			return err
+		}
+		if reply[1] != 0x00 {
+			return ErrorProxyAuth
+		}
+	default:
+		return ErrorProxyAuth
+	}
+
+	req := []byte{socksVersion, socksConnect, 0x00}
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			req = append(req, socksIPv4)
+			req = append(req, ip4...)
+		} else {
+			req = append(req, socksIPv6)
+			req = append(req, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return errors.New("socks5: host name too long")
+		}
+		req = append(req, socksDomain, byte(len(host)))
+		req = append(req, host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+
+	var head [4]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return err
+	}
+	if head[0] != socksVersion {
+		return errorSocksVersion
+	}
+	if head[1] != 0x00 {
+		msg := "unknown error"
+		if int(head[1]) < len(socksReplies) {
+			msg = socksReplies[head[1]]
+		}
+		return fmt.Errorf("socks5: %s", msg)
+	}
+
+	var skip int
+	switch head[3] {
+	case socksIPv4:
+		skip = net.IPv4len
+	case socksIPv6:
+		skip = net.IPv6len
+	case socksDomain:
+		var l [1]byte
+		if _, err := io.ReadFull(conn, l[:]); err != nil {
+			return err
+		}
+		skip = int(l[0])
+	default:
+		return errors.New("socks5: unknown address type")
+	}
+	_, err := io.ReadFull(conn, make([]byte, skip+2))
+
+	return err
+}
+
+func getenvAny(names ...string) string {
+	for _, n := range names {
+		if v := os.Getenv(n); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// ProxyFromEnvironment returns the proxy for addr configured by HTTPS_PROXY
+// or ALL_PROXY, honoring NO_PROXY. Values without a scheme are treated as
+// HTTP proxies.
+func ProxyFromEnvironment(addr string) (*url.URL, error) {
+	proxy := getenvAny("HTTPS_PROXY", "https_proxy")
+	if proxy == "" {
+		proxy = getenvAny("ALL_PROXY", "all_proxy")
+	}
+	if proxy == "" || !useProxy(addr, getenvAny("NO_PROXY", "no_proxy")) {
+		return nil, nil
+	}
+
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy address %q: %w", proxy, err)
+	}
+
+	return u, nil
+}
+
+func useProxy(addr, noProxy string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsLoopback() {
+		return false
+	}
+
+	for _, entry := range strings.Split(noProxy, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+		if entry == "*" {
+			return false
+		}
+		if _, cidr, err := net.ParseCIDR(entry); err == nil {
+			if ip != nil && cidr.Contains(ip) {
+				return false
+			}
+			continue
+		}
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			if p != port {
+				continue
+			}
+			entry = h
+		}
+		if eip := net.ParseIP(entry); eip != nil {
+			if ip != nil && eip.Equal(ip) {
+				return false
+			}
+			continue
+		}
+		entry = strings.TrimPrefix(entry, "*")
+		if host == strings.TrimPrefix(entry, ".") || strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")) {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,154 @@
+package tunl_test
+
+import (
+	"bufio"
+	"context"
+	"github.com/black40x/tunl-core/tunl"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// connectProxy answers every CONNECT with 200 and echoes the tunnel, or
+// never answers when stall is set.
+func connectProxy(t *testing.T, stall bool) *url.URL {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				br := bufio.NewReader(conn)
+				if _, err := http.ReadRequest(br); err != nil || stall {
+					io.Copy(io.Discard, br)
+					return
+				}
+				io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+				io.Copy(conn, br)
+			}()
+		}
+	}()
+
+	return &url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+func TestDialConnectKeepsConn(t *testing.T) {
+	p := connectProxy(t, false)
+	d := &tunl.Dialer{
+		Proxy:   func(string) (*url.URL, error) { return p, nil },
+		Timeout: 5 * time.Second,
+	}
+
+	for i := 0; i < 100; i++ {
+		conn, err := d.DialContext(context.Background(), "tcp", "example.com:443")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err = io.WriteString(conn, "ping"); err != nil {
+			t.Fatalf("write after dial: %v", err)
+		}
+		buf := make([]byte, 4)
+		if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("read after dial: %q %v", buf, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestDialConnectCancel(t *testing.T) {
+	p := connectProxy(t, true)
+	d := &tunl.Dialer{Proxy: func(string) (*url.URL, error) { return p, nil }}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := d.DialContext(ctx, "tcp", "example.com:443"); err == nil {
+		t.Fatal("dial through a stalled proxy succeeded")
+	}
+}
+
+// socksProxy accepts the method negotiation and answers every CONNECT with
+// a success reply carrying the given version byte, then echoes the tunnel.
+func socksProxy(t *testing.T, version byte) *url.URL {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				hello := make([]byte, 3)
+				if _, err := io.ReadFull(conn, hello); err != nil {
+					return
+				}
+				conn.Write([]byte{5, 0})
+				// A request for an IPv4 address is always ten bytes.
+				req := make([]byte, 10)
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+				conn.Write([]byte{version, 0, 0, 1, 127, 0, 0, 1, 0, 80})
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return &url.URL{Scheme: "socks5", Host: l.Addr().String()}
+}
+
+func TestDialSocks5(t *testing.T) {
+	p := socksProxy(t, 5)
+	d := &tunl.Dialer{
+		Proxy:   func(string) (*url.URL, error) { return p, nil },
+		Timeout: 5 * time.Second,
+	}
+
+	conn, err := d.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err = io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read after dial: %q %v", buf, err)
+	}
+}
+
+func TestDialSocks5ReplyVersion(t *testing.T) {
+	p := socksProxy(t, 4)
+	d := &tunl.Dialer{
+		Proxy:   func(string) (*url.URL, error) { return p, nil },
+		Timeout: 5 * time.Second,
+	}
+
+	if conn, err := d.DialContext(context.Background(), "tcp", "10.0.0.1:80"); err == nil {
+		conn.Close()
+		t.Fatal("dial accepted a reply with the wrong version")
+	}
+}
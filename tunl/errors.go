@@ -0,0 +1,191 @@
+package tunl
+
+import (
+	"errors"
+	"fmt"
+	"github.com/black40x/tunl-core/commands"
+	"sync"
+	"time"
+)
+
+type ErrorCategory = commands.Error_Category
+
+const (
+	CategoryUnknown  = commands.Error_UNKNOWN
+	CategoryAuth     = commands.Error_AUTH
+	CategoryQuota    = commands.Error_QUOTA
+	CategoryProtocol = commands.Error_PROTOCOL
+	CategoryUpstream = commands.Error_UPSTREAM
+	CategoryInternal = commands.Error_INTERNAL
+)
+
+// Error is the Go side of commands.Error. Two errors match with errors.Is
+// when their codes are equal, so a received error can be checked against
+// NewError(code, "").
+type Error struct {
+	Code       int32
+	Message    string
+	Category   ErrorCategory
+	Retryable  bool
+	RetryAfter time.Duration
+	Details    map[string]string
+	cause      error
+}
+
+type errorCode struct {
+	category  ErrorCategory
+	retryable bool
+}
+
+var (
+	errorCodesMu sync.RWMutex
+	errorCodes   = map[int32]errorCode{
+		ErrorServerFull:     {CategoryQuota, true},
+		ErrorUnauthorized:   {CategoryAuth, false},
+		ErrorSessionExpired: {CategoryQuota, false},
+		ErrorClientResponse: {CategoryUpstream, false},
+		ErrorServerRequest:  {CategoryInternal, true},
+		ErrorProtocol:       {CategoryProtocol, false},
+		ErrorRateLimited:    {CategoryQuota, true},
+		ErrorInternal:       {CategoryInternal, true},
+		ErrorTunnelOffline:  {CategoryUpstream, true},
+
+		ErrorUpstreamRefused:      {CategoryUpstream, true},
+		ErrorUpstreamTimeout:      {CategoryUpstream, true},
+		ErrorUpstreamTLS:          {CategoryUpstream, false},
+		ErrorUpstreamDNS:          {CategoryUpstream, true},
+		ErrorUpstreamBodyTooLarge: {CategoryUpstream, false},
+	}
+)
+
+// RegisterErrorCode sets the category and retry behaviour NewError uses for
+// an application-defined code.
+func RegisterErrorCode(code int32, category ErrorCategory, retryable bool) {
+	errorCodesMu.Lock()
+	defer errorCodesMu.Unlock()
+	errorCodes[code] = errorCode{category, retryable}
+}
+
+func lookupErrorCode(code int32) errorCode {
+	errorCodesMu.RLock()
+	defer errorCodesMu.RUnlock()
+	return errorCodes[code]
+}
+
+// NewError returns an error with the category and retry behaviour registered
+// for code.
+func NewError(code int32, message string) *Error {
+	c := lookupErrorCode(code)
+	return &Error{
+		Code:      code,
+		Message:   message,
+		Category:  c.category,
+		Retryable: c.retryable,
+	}
+}
+
+// WrapError is NewError with err as the message and the cause.
+func WrapError(code int32, err error) *Error {
+	e := NewError(code, err.Error())
+	e.cause = err
+	return e
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("tunl error %d", e.Code)
+	}
+	return fmt.Sprintf("tunl error %d: %s", e.Code, e.Message)
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t != nil && e != nil && t.Code == e.Code
+}
+
+func (e *Error) Unwrap() error {
+	if e == nil {
+		return nil
+	}
+	return e.cause
+}
+
+// WithDetail returns a copy of the error with key set in its details.
+func (e *Error) WithDetail(key, value string) *Error {
+	c := *e
+	c.Details = make(map[string]string, len(e.Details)+1)
+	for k, v := range e.Details {
+		c.Details[k] = v
+	}
+	c.Details[key] = value
+
+	return &c
+}
+
+// WithRetryAfter returns a retryable copy of the error that asks the peer to
+// wait d before trying again.
+func (e *Error) WithRetryAfter(d time.Duration) *Error {
+	c := *e
+	c.Retryable = true
+	c.RetryAfter = d
+
+	return &c
+}
+
+func (e *Error) Proto() *commands.Error {
+	return &commands.Error{
+		Code:         e.Code,
+		Message:      e.Message,
+		Category:     e.Category,
+		Retryable:    e.Retryable,
+		RetryAfterMs: e.RetryAfter.Milliseconds(),
+		Details:      e.Details,
+	}
+}
+
+// ErrorFromProto converts a received commands.Error. Peers that predate
+// categories send none, so the registered ones are used instead.
+func ErrorFromProto(m *commands.Error) *Error {
+	e := &Error{
+		Code:       m.GetCode(),
+		Message:    m.GetMessage(),
+		Category:   m.GetCategory(),
+		Retryable:  m.GetRetryable(),
+		RetryAfter: time.Duration(m.GetRetryAfterMs()) * time.Millisecond,
+		Details:    m.GetDetails(),
+	}
+	if e.Category == CategoryUnknown {
+		c := lookupErrorCode(e.Code)
+		e.Category = c.category
+		e.Retryable = e.Retryable || c.retryable
+	}
+
+	return e
+}
+
+// ErrorToProto converts any error for sending to the peer. Errors that are
+// not an *Error are reported as protocol or internal errors.
+func ErrorToProto(err error) *commands.Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Proto()
+	}
+
+	switch {
+	case errors.Is(err, ErrorInvalidFrame),
+		errors.Is(err, ErrorFrameTooLarge),
+		errors.Is(err, ErrorUnknownCompression),
+		errors.Is(err, ErrorNotSealed),
+		errors.Is(err, ErrorUnseal):
+		return WrapError(ErrorProtocol, err).Proto()
+	}
+
+	return WrapError(ErrorInternal, err).Proto()
+}
+
+// IsRetryable reports whether err, or an *Error it wraps, may succeed when
+// tried again.
+func IsRetryable(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.Retryable
+}
@@ -0,0 +1,39 @@
+package tunl_test
+
+import (
+	"errors"
+	"fmt"
+	"github.com/black40x/tunl-core/tunl"
+	"testing"
+)
+
+func TestErrorIs(t *testing.T) {
+	err := fmt.Errorf("proxy: %w", tunl.NewError(tunl.ErrorUpstreamTimeout, "slow"))
+
+	if !errors.Is(err, tunl.NewError(tunl.ErrorUpstreamTimeout, "")) {
+		t.Fatal("same code does not match")
+	}
+	if errors.Is(err, tunl.NewError(tunl.ErrorUpstreamDNS, "")) {
+		t.Fatal("other code matches")
+	}
+	if errors.Is(err, (*tunl.Error)(nil)) {
+		t.Fatal("nil target matches")
+	}
+
+	var nilErr *tunl.Error
+	if errors.Is(nilErr, tunl.NewError(tunl.ErrorUpstreamTimeout, "")) {
+		t.Fatal("nil error matches")
+	}
+}
+
+func TestErrorProto(t *testing.T) {
+	e := tunl.NewError(tunl.ErrorRateLimited, "slow down").WithDetail("limit", "10")
+	got := tunl.ErrorFromProto(e.Proto())
+
+	if got.Code != e.Code || got.Message != e.Message || got.Details["limit"] != "10" {
+		t.Fatalf("round trip changed %+v into %+v", e, got)
+	}
+	if !tunl.IsRetryable(got) {
+		t.Fatal("rate limited error is not retryable")
+	}
+}
@@ -0,0 +1,63 @@
+package tunl
+
+import (
+	"github.com/black40x/tunl-core/commands"
+	"testing"
+)
+
+func skipped(c *compressionFilter) int {
+	n := 0
+	c.skip.Range(func(key, value interface{}) bool {
+		n++
+		return true
+	})
+	return n
+}
+
+func compressedResponse(uuid string, status int32, errorCode int64) *commands.HttpResponse {
+	return &commands.HttpResponse{
+		Uuid:      uuid,
+		Status:    status,
+		ErrorCode: errorCode,
+		Header:    []*commands.Header{{Key: "Content-Type", Value: []string{"image/png"}}},
+	}
+}
+
+func TestCompressionFilterRelease(t *testing.T) {
+	tests := []struct {
+		name string
+		msgs []interface{}
+		left int
+	}{
+		{"eof chunk", []interface{}{compressedResponse("a", 200, 0), &commands.BodyChunk{Uuid: "a", Eof: true}}, 0},
+		{"no eof yet", []interface{}{compressedResponse("a", 200, 0), &commands.BodyChunk{Uuid: "a"}}, 1},
+		{"no content", []interface{}{compressedResponse("a", 204, 0)}, 0},
+		{"not modified", []interface{}{compressedResponse("a", 304, 0)}, 0},
+		{"informational", []interface{}{compressedResponse("a", 103, 0)}, 0},
+		{"error", []interface{}{compressedResponse("a", 502, 1)}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c compressionFilter
+			for _, m := range tt.msgs {
+				c.allow(m)
+			}
+			if n := skipped(&c); n != tt.left {
+				t.Fatalf("%d entries left, want %d", n, tt.left)
+			}
+		})
+	}
+}
+
+func TestEndStream(t *testing.T) {
+	c := NewTunlConnTransport(nil, nil)
+
+	// A HEAD response has a body status but never sends an EOF chunk.
+	if c.filter.allow(compressedResponse("a", 200, 0)); skipped(&c.filter) != 1 {
+		t.Fatal("compressed response not remembered")
+	}
+	c.EndStream("a")
+	if n := skipped(&c.filter); n != 0 {
+		t.Fatalf("%d entries left after EndStream", n)
+	}
+}
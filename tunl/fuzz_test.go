@@ -0,0 +1,114 @@
+package tunl_test
+
+import (
+	"github.com/black40x/tunl-core/commands"
+	"github.com/black40x/tunl-core/tunl"
+	"github.com/black40x/tunl-core/tunl/conformance"
+	"github.com/black40x/tunl-core/tunl/tunltest"
+	"google.golang.org/protobuf/proto"
+	"net"
+	"testing"
+)
+
+const fuzzMaxFrameSize = 1 << 16
+
+func goldenFrames(f *testing.F) [][]byte {
+	var frames [][]byte
+	for _, c := range conformance.Cases() {
+		frame, err := c.Golden()
+		if err != nil {
+			f.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// FuzzRead feeds arbitrary byte streams to TunlConn.Read. Reading must end
+// with an error instead of panicking or hanging, and never return more than
+// MaxFrameSize bytes.
+func FuzzRead(f *testing.F) {
+	for _, frame := range goldenFrames(f) {
+		f.Add(frame)
+	}
+	f.Add(tunltest.Prefix(0))
+	f.Add(tunltest.Prefix(tunl.FramePrefixSize - 1))
+	f.Add(tunltest.Prefix(0xffffffff))
+	f.Add(tunltest.EncodeFrame([]byte("not a transfer"), true))
+
+	f.Fuzz(func(t *testing.T, stream []byte) {
+		a, b := net.Pipe()
+		conn := tunl.NewTunlConnConfig(a, &tunl.Config{MaxFrameSize: fuzzMaxFrameSize})
+		defer conn.Close()
+		if err := conn.SetCompression("gzip"); err != nil {
+			t.Fatal(err)
+		}
+
+		go func() {
+			b.Write(stream)
+			b.Close()
+		}()
+
+		for {
+			data, err := conn.Read()
+			if err != nil {
+				return
+			}
+			if len(data) > fuzzMaxFrameSize {
+				t.Fatalf("read %d bytes, limit is %d", len(data), fuzzMaxFrameSize)
+			}
+		}
+	})
+}
+
+// FuzzTransfer decodes arbitrary payloads as a Transfer the way
+// HandleConnection does, and checks that whatever decodes survives a round
+// trip.
+func FuzzTransfer(f *testing.F) {
+	for _, frame := range goldenFrames(f) {
+		f.Add(frame[tunl.FramePrefixSize:])
+	}
+
+	f.Fuzz(func(t *testing.T, payload []byte) {
+		trans := &commands.Transfer{}
+		if err := (proto.UnmarshalOptions{Merge: true}).Unmarshal(payload, trans); err != nil {
+			return
+		}
+
+		out, err := proto.Marshal(trans)
+		if err != nil {
+			t.Fatal(err)
+		}
+		again := &commands.Transfer{}
+		if err = proto.Unmarshal(out, again); err != nil {
+			t.Fatal(err)
+		}
+		if !proto.Equal(trans, again) {
+			t.Fatalf("round trip changed %v into %v", trans, again)
+		}
+		// Unknown fields of the Transfer itself are not carried over by
+		// NewTransfer, only those of the command.
+		trans.ProtoReflect().SetUnknown(nil)
+		if m := trans.Message(); m != nil && !proto.Equal(commands.NewTransfer(m), trans) {
+			t.Fatalf("NewTransfer(Message()) changed %v", trans)
+		}
+	})
+}
+
+// FuzzAddress runs arbitrary strings through the address parser.
+func FuzzAddress(f *testing.F) {
+	for _, s := range []string{"8080", "127.0.0.1:3000", "http://localhost:8080", "https://example.com", "dir:///var/www", "DIR://x", "dir://"} {
+		f.Add(s)
+	}
+
+	f.Fuzz(func(t *testing.T, s string) {
+		addr, err := tunl.NewAddress(s)
+		if err != nil {
+			return
+		}
+		if addr.ToString() == "" && addr.Type() != tunl.DIR {
+			t.Fatalf("%q has no address", s)
+		}
+		addr.ToProtoString()
+	})
+}
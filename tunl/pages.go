@@ -0,0 +1,309 @@
+package tunl
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/black40x/tunl-core/commands"
+	"html/template"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrorPage is what the public client is shown for a tunl error code.
+type ErrorPage struct {
+	Code    int32
+	Status  int
+	Name    string
+	Title   string
+	Message string
+}
+
+var errorPages = map[int32]ErrorPage{
+	ErrorServerFull: {
+		Status:  http.StatusServiceUnavailable,
+		Name:    "server_full",
+		Title:   "Server full",
+		Message: "The tunnel server has no free slots right now. Try again later.",
+	},
+	ErrorUnauthorized: {
+		Status:  http.StatusUnauthorized,
+		Name:    "unauthorized",
+		Title:   "Unauthorized",
+		Message: "You are not allowed to access this tunnel.",
+	},
+	ErrorSessionExpired: {
+		Status:  http.StatusGone,
+		Name:    "expired",
+		Title:   "Tunnel expired",
+		Message: "This tunnel session has expired.",
+	},
+	ErrorClientResponse: {
+		Status:  http.StatusBadGateway,
+		Name:    "bad_gateway",
+		Title:   "Bad gateway",
+		Message: "The local service returned an invalid response.",
+	},
+	ErrorServerRequest: {
+		Status:  http.StatusBadGateway,
+		Name:    "tunnel_error",
+		Title:   "Tunnel error",
+		Message: "The request could not be passed through the tunnel.",
+	},
+	ErrorProtocol: {
+		Status:  http.StatusBadGateway,
+		Name:    "protocol_error",
+		Title:   "Protocol error",
+		Message: "The tunnel client sent an invalid response.",
+	},
+	ErrorRateLimited: {
+		Status:  http.StatusTooManyRequests,
+		Name:    "rate_limited",
+		Title:   "Too many requests",
+		Message: "This tunnel is receiving too many requests. Slow down and try again.",
+	},
+	ErrorInternal: {
+		Status:  http.StatusInternalServerError,
+		Name:    "internal_error",
+		Title:   "Internal error",
+		Message: "Something went wrong on the tunnel server.",
+	},
+	ErrorTunnelOffline: {
+		Status:  http.StatusBadGateway,
+		Name:    "offline",
+		Title:   "Tunnel offline",
+		Message: "No client is connected to this tunnel right now.",
+	},
+	ErrorUpstreamRefused: {
+		Status:  http.StatusBadGateway,
+		Name:    "connection_refused",
+		Title:   "Connection refused",
+		Message: "The tunnel is up, but the local service refused the connection. Make sure it is running.",
+	},
+	ErrorUpstreamTimeout: {
+		Status:  http.StatusGatewayTimeout,
+		Name:    "timeout",
+		Title:   "Gateway timeout",
+		Message: "The local service did not answer in time.",
+	},
+	ErrorUpstreamTLS: {
+		Status:  http.StatusBadGateway,
+		Name:    "tls_error",
+		Title:   "TLS error",
+		Message: "A secure connection to the local service could not be established.",
+	},
+	ErrorUpstreamDNS: {
+		Status:  http.StatusBadGateway,
+		Name:    "dns_failure",
+		Title:   "Host not found",
+		Message: "The host name of the local service could not be resolved.",
+	},
+	ErrorUpstreamBodyTooLarge: {
+		Status:  http.StatusRequestEntityTooLarge,
+		Name:    "body_too_large",
+		Title:   "Payload too large",
+		Message: "The request body is larger than the tunnel accepts.",
+	},
+}
+
+// LookupErrorPage returns the built-in page for code. Unknown codes get the
+// generic bad gateway page and false.
+func LookupErrorPage(code int32) (ErrorPage, bool) {
+	p, ok := errorPages[code]
+	if !ok {
+		p = errorPages[ErrorClientResponse]
+	}
+	p.Code = code
+
+	return p, ok
+}
+
+const defaultPageTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Status}} {{.Title}}</title>
+<style>
+body{margin:0;font-family:-apple-system,BlinkMacSystemFont,"Segoe UI",Roboto,sans-serif;background:#f6f7f9;color:#1f2328}
+main{max-width:36rem;margin:15vh auto;padding:0 1.5rem}
+h1{font-size:1.5rem;margin:0 0 .75rem}
+p{line-height:1.5;margin:0 0 1rem}
+small{color:#6e7781}
+</style>
+</head>
+<body>
+<main>
+<h1>{{.Title}}</h1>
+<p>{{.Message}}</p>
+<p><small>{{with .Data.brand}}{{.}}{{else}}tunl{{end}} &middot; error {{.Code}}</small></p>
+</main>
+</body>
+</html>
+`
+
+var defaultPage = template.Must(template.New("page").Parse(defaultPageTemplate))
+
+// PageData is passed to page templates.
+type PageData struct {
+	ErrorPage
+	Request *commands.HttpRequest
+	Data    map[string]string
+}
+
+// Pages renders error pages for public clients: HTML for browsers and JSON
+// for everything else. Templates and texts can be replaced per code.
+type Pages struct {
+	mu        sync.RWMutex
+	pages     map[int32]ErrorPage
+	templates map[int32]*template.Template
+	fallback  *template.Template
+	data      map[string]string
+}
+
+var DefaultPages = NewPages()
+
+func NewPages() *Pages {
+	return &Pages{
+		pages:     map[int32]ErrorPage{},
+		templates: map[int32]*template.Template{},
+		fallback:  defaultPage,
+	}
+}
+
+// SetPage replaces the status and texts shown for page.Code.
+func (p *Pages) SetPage(page ErrorPage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pages[page.Code] = page
+}
+
+// SetTemplate renders code with t instead of the default template.
+func (p *Pages) SetTemplate(code int32, t *template.Template) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.templates[code] = t
+}
+
+// SetDefaultTemplate replaces the template used for codes without their own.
+func (p *Pages) SetDefaultTemplate(t *template.Template) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.fallback = t
+}
+
+// SetData sets values available to templates as .Data, such as "brand".
+func (p *Pages) SetData(data map[string]string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.data = data
+}
+
+func (p *Pages) lookup(code int32) (ErrorPage, *template.Template, map[string]string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	page, ok := p.pages[code]
+	if !ok {
+		page, _ = LookupErrorPage(code)
+	}
+	page.Code = code
+
+	t := p.templates[code]
+	if t == nil {
+		t = p.fallback
+	}
+
+	return page, t, p.data
+}
+
+// wantsHTML negotiates between HTML and JSON. The user agent decides ties,
+// such as */*, and requests that accept neither.
+func wantsHTML(req *commands.HttpRequest) bool {
+	offers := []string{"application/json", "text/html"}
+	if req.IsBrowserRequest() {
+		offers[0], offers[1] = offers[1], offers[0]
+	}
+
+	switch req.Negotiate(offers...) {
+	case "text/html":
+		return true
+	case "application/json":
+		return false
+	}
+
+	return req.IsBrowserRequest()
+}
+
+type pageJSON struct {
+	Error   string `json:"error"`
+	Code    int32  `json:"code"`
+	Message string `json:"message"`
+}
+
+// Render returns the body and content type of the page for code.
+func (p *Pages) Render(req *commands.HttpRequest, code int32) (ErrorPage, []byte, string) {
+	page, t, data := p.lookup(code)
+
+	if !wantsHTML(req) {
+		body, _ := json.Marshal(pageJSON{Error: page.Name, Code: page.Code, Message: page.Message})
+		return page, body, "application/json"
+	}
+
+	var b bytes.Buffer
+	pd := PageData{ErrorPage: page, Request: req, Data: data}
+	if err := t.Execute(&b, pd); err != nil {
+		b.Reset()
+		defaultPage.Execute(&b, pd)
+	}
+
+	return page, b.Bytes(), "text/html; charset=utf-8"
+}
+
+// Response builds the complete answer to req for code. The body is complete
+// in the returned chunk.
+func (p *Pages) Response(req *commands.HttpRequest, code int32) (*commands.HttpResponse, *commands.BodyChunk) {
+	page, body, contentType := p.Render(req, code)
+
+	resp := &commands.HttpResponse{
+		Uuid:          req.GetUuid(),
+		Proto:         "HTTP/1.1",
+		Status:        int32(page.Status),
+		ContentLength: int64(len(body)),
+		Header: []*commands.Header{
+			{Key: "Content-Type", Value: []string{contentType}},
+			{Key: "Content-Length", Value: []string{strconv.Itoa(len(body))}},
+			{Key: "Cache-Control", Value: []string{"no-store"}},
+		},
+		ErrorCode: int64(code),
+	}
+
+	return resp, &commands.BodyChunk{Uuid: req.GetUuid(), Body: body, Eof: true}
+}
+
+// ErrorResponse is Response for a structured error, adding Retry-After when
+// the error carries one.
+func (p *Pages) ErrorResponse(req *commands.HttpRequest, err *Error) (*commands.HttpResponse, *commands.BodyChunk) {
+	resp, chunk := p.Response(req, err.Code)
+	if err.RetryAfter > 0 {
+		secs := int64((err.RetryAfter + time.Second - 1) / time.Second)
+		resp.Header = append(resp.Header, &commands.Header{
+			Key:   "Retry-After",
+			Value: []string{strconv.FormatInt(secs, 10)},
+		})
+	}
+
+	return resp, chunk
+}
+
+// Send answers req through t with the page for code.
+func (p *Pages) Send(t *TunlConn, req *commands.HttpRequest, code int32) error {
+	resp, chunk := p.Response(req, code)
+	if _, err := t.Send(resp); err != nil {
+		return err
+	}
+	_, err := t.Send(chunk)
+
+	return err
+}
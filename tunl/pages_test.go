@@ -0,0 +1,122 @@
+package tunl_test
+
+import (
+	"encoding/json"
+	"github.com/black40x/tunl-core/commands"
+	"github.com/black40x/tunl-core/tunl"
+	"html/template"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const browserAgent = "Mozilla/5.0 (X11; Linux x86_64) Firefox/120.0"
+
+func pageRequest(accept, userAgent string) *commands.HttpRequest {
+	req := &commands.HttpRequest{Uuid: "r", Method: "GET", Uri: "/"}
+	if accept != "" {
+		req.Headers().Set("Accept", accept)
+	}
+	if userAgent != "" {
+		req.Headers().Set("User-Agent", userAgent)
+	}
+	return req
+}
+
+func TestPagesRenderNegotiates(t *testing.T) {
+	tests := []struct {
+		name      string
+		accept    string
+		userAgent string
+		html      bool
+	}{
+		{"html", "text/html", "", true},
+		{"json", "application/json", browserAgent, false},
+		{"browser default", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", browserAgent, true},
+		{"wildcard browser", "*/*", browserAgent, true},
+		{"wildcard client", "*/*", "curl/8.0", false},
+		{"no accept browser", "", browserAgent, true},
+		{"no accept client", "", "", false},
+		{"html refused", "text/html;q=0, */*", browserAgent, false},
+		{"json preferred", "text/html;q=0.5, application/json", browserAgent, false},
+		{"html preferred", "application/json;q=0.5, text/html", "", true},
+		{"text wildcard", "text/*", "", true},
+		{"neither browser", "image/png", browserAgent, true},
+		{"neither client", "image/png", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, body, contentType := tunl.NewPages().Render(pageRequest(tt.accept, tt.userAgent), tunl.ErrorSessionExpired)
+
+			if html := strings.HasPrefix(contentType, "text/html"); html != tt.html {
+				t.Fatalf("content type %q, want html=%v", contentType, tt.html)
+			}
+			if tt.html {
+				if !strings.Contains(string(body), "Tunnel expired") {
+					t.Fatalf("html body: %s", body)
+				}
+				return
+			}
+			var page struct {
+				Error string `json:"error"`
+				Code  int32  `json:"code"`
+			}
+			if err := json.Unmarshal(body, &page); err != nil || page.Error != "expired" || page.Code != tunl.ErrorSessionExpired {
+				t.Fatalf("json body %s: %v", body, err)
+			}
+		})
+	}
+}
+
+func TestPagesTemplates(t *testing.T) {
+	p := tunl.NewPages()
+	p.SetData(map[string]string{"brand": "acme"})
+	p.SetTemplate(tunl.ErrorServerFull, template.Must(template.New("full").Parse(`full {{.Status}} {{.Data.brand}}`)))
+	p.SetDefaultTemplate(template.Must(template.New("broken").Parse(`{{.Missing.Field}}`)))
+	req := pageRequest("text/html", "")
+
+	if _, body, _ := p.Render(req, tunl.ErrorServerFull); string(body) != "full 503 acme" {
+		t.Fatalf("custom template: %s", body)
+	}
+	// A template that fails falls back to the built-in page.
+	if _, body, _ := p.Render(req, tunl.ErrorSessionExpired); !strings.Contains(string(body), "acme &middot; error") {
+		t.Fatalf("fallback page: %s", body)
+	}
+}
+
+func TestPagesResponse(t *testing.T) {
+	resp, chunk := tunl.NewPages().Response(pageRequest("application/json", ""), tunl.ErrorSessionExpired)
+
+	if resp.GetStatus() != http.StatusGone || resp.GetErrorCode() != int64(tunl.ErrorSessionExpired) {
+		t.Fatalf("response: %v", resp)
+	}
+	if ct := resp.Headers().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("content type %q", ct)
+	}
+	if resp.GetUuid() != "r" || chunk.GetUuid() != "r" || !chunk.GetEof() || resp.GetContentLength() != int64(len(chunk.GetBody())) {
+		t.Fatalf("response %v with chunk %v", resp, chunk)
+	}
+}
+
+func TestPagesAuthorize(t *testing.T) {
+	p := tunl.NewPages()
+	p.SetPage(tunl.ErrorPage{Code: tunl.ErrorUnauthorized, Status: http.StatusUnauthorized, Name: "login", Message: "Sign in first."})
+	a := &tunl.BasicAuthenticator{Realm: "r", Verify: func(user, pass string) bool { return pass == "secret" }}
+
+	req := pageRequest("application/json", "")
+	user, resp, chunk := p.Authorize(a, req)
+	if user != "" || resp.GetStatus() != http.StatusUnauthorized {
+		t.Fatalf("unauthorized request: %q %v", user, resp)
+	}
+	if got := resp.Headers().Get("WWW-Authenticate"); !strings.HasPrefix(got, "Basic ") {
+		t.Fatalf("challenge %q", got)
+	}
+	if !strings.Contains(string(chunk.GetBody()), "Sign in first.") {
+		t.Fatalf("page not rendered with p: %s", chunk.GetBody())
+	}
+
+	req.Headers().Set("Authorization", "Basic dXNlcjpzZWNyZXQ=")
+	if user, resp, _ = p.Authorize(a, req); user != "user" || resp != nil {
+		t.Fatalf("authorized request: %q %v", user, resp)
+	}
+}
@@ -0,0 +1,38 @@
+package tunl
+
+import "sync"
+
+var bufferClasses = [...]int{4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20}
+
+var bufferPools [len(bufferClasses)]sync.Pool
+
+// getBuffer returns an empty buffer with capacity for at least n bytes,
+// taken from the smallest size class that fits.
+func getBuffer(n int) *[]byte {
+	for i, c := range bufferClasses {
+		if n <= c {
+			if b, ok := bufferPools[i].Get().(*[]byte); ok {
+				*b = (*b)[:0]
+				return b
+			}
+			b := make([]byte, 0, c)
+			return &b
+		}
+	}
+
+	b := make([]byte, 0, n)
+	return &b
+}
+
+func putBuffer(b *[]byte) {
+	c := cap(*b)
+	if c > bufferClasses[len(bufferClasses)-1] {
+		return
+	}
+	for i := len(bufferClasses) - 1; i >= 0; i-- {
+		if c >= bufferClasses[i] {
+			bufferPools[i].Put(b)
+			return
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package tunl
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+type QueuePolicy int
+
+const (
+	// QueueBlock makes senders wait for room, up to the write timeout.
+	QueueBlock QueuePolicy = iota
+	// QueueDrop discards frames that do not fit.
+	QueueDrop
+	// QueueDisconnect closes the connection once the queue overflows.
+	QueueDisconnect
+)
+
+var (
+	ErrorQueueFull    = errors.New("send queue full")
+	ErrorSlowConsumer = errors.New("slow consumer")
+	ErrorWriteTimeout = errors.New("write timeout")
+)
+
+type priority int
+
+const (
+	priorityControl priority = iota
+	priorityHeader
+	priorityData
+)
+
+type outFrame struct {
+	buf        *[]byte
+	compressed bool
+}
+
+type lane struct {
+	frames []outFrame
+	head   int
+}
+
+func (l *lane) len() int {
+	return len(l.frames) - l.head
+}
+
+func (l *lane) push(b outFrame) {
+	l.frames = append(l.frames, b)
+}
+
+func (l *lane) pop() outFrame {
+	b := l.frames[l.head]
+	l.frames[l.head] = outFrame{}
+	l.head++
+	if l.head == len(l.frames) {
+		l.frames = l.frames[:0]
+		l.head = 0
+	} else if l.head > len(l.frames)/2 {
+		n := copy(l.frames, l.frames[l.head:])
+		l.frames = l.frames[:n]
+		l.head = 0
+	}
+	return b
+}
+
+func (l *lane) discard() int {
+	n := l.len()
+	for i := l.head; i < len(l.frames); i++ {
+		putBuffer(l.frames[i].buf)
+		l.frames[i] = outFrame{}
+	}
+	l.frames = l.frames[:0]
+	l.head = 0
+	return n
+}
+
+// frameQueue is a bounded scheduler for outgoing frames. Control commands
+// go first, then request and response headers, and body data is served
+// round-robin between streams so that one large transfer cannot starve the
+// others. Frames of the same stream keep their order.
+type frameQueue struct {
+	mu        sync.Mutex
+	control   lane
+	header    lane
+	streams   map[string]*lane
+	active    []string
+	next      int
+	size      int
+	limit     int
+	highWater int
+	closed    bool
+	closedC   chan struct{}
+	ready     chan struct{}
+	space     chan struct{}
+}
+
+func newFrameQueue(limit int) *frameQueue {
+	return &frameQueue{
+		streams: make(map[string]*lane),
+		limit:   limit,
+		closedC: make(chan struct{}),
+		ready:   make(chan struct{}, 1),
+		space:   make(chan struct{}, 1),
+	}
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+func (q *frameQueue) push(b outFrame, prio priority, key string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrorConnectionClosed
+	}
+	if q.size >= q.limit {
+		return ErrorQueueFull
+	}
+
+	switch prio {
+	case priorityControl:
+		q.control.push(b)
+	case priorityHeader:
+		q.header.push(b)
+	default:
+		l, ok := q.streams[key]
+		if !ok {
+			l = &lane{}
+			q.streams[key] = l
+			q.active = append(q.active, key)
+		}
+		l.push(b)
+	}
+
+	q.size++
+	if q.size > q.highWater {
+		q.highWater = q.size
+	}
+	if q.size < q.limit {
+		notify(q.space)
+	}
+	notify(q.ready)
+
+	return nil
+}
+
+func (q *frameQueue) pushWait(b outFrame, prio priority, key string, timeout time.Duration) error {
+	var timeoutC <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutC = timer.C
+	}
+
+	for {
+		err := q.push(b, prio, key)
+		if err != ErrorQueueFull {
+			return err
+		}
+		select {
+		case <-q.space:
+		case <-q.closedC:
+			return ErrorConnectionClosed
+		case <-timeoutC:
+			return ErrorWriteTimeout
+		}
+	}
+}
+
+func (q *frameQueue) pop() (outFrame, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.size == 0 {
+		return outFrame{}, false
+	}
+
+	var b outFrame
+	switch {
+	case q.control.len() > 0:
+		b = q.control.pop()
+	case q.header.len() > 0:
+		b = q.header.pop()
+	default:
+		if q.next >= len(q.active) {
+			q.next = 0
+		}
+		key := q.active[q.next]
+		l := q.streams[key]
+		b = l.pop()
+		if l.len() == 0 {
+			delete(q.streams, key)
+			q.active = append(q.active[:q.next], q.active[q.next+1:]...)
+		} else {
+			q.next++
+		}
+	}
+
+	q.size--
+	notify(q.space)
+
+	return b, true
+}
+
+func (q *frameQueue) depth() (depth, highWater int) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.size, q.highWater
+}
+
+func (q *frameQueue) isClosed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.closed
+}
+
+func (q *frameQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.closedC)
+		notify(q.ready)
+	}
+}
+
+// discard returns frames that will never be written to the pool.
+func (q *frameQueue) discard() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := q.control.discard() + q.header.discard()
+	for _, l := range q.streams {
+		n += l.discard()
+	}
+	q.streams = make(map[string]*lane)
+	q.active = nil
+	q.next = 0
+	q.size = 0
+
+	return n
+}
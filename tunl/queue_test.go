@@ -0,0 +1,133 @@
+package tunl
+
+import "testing"
+
+func queuedFrame(name string) outFrame {
+	b := []byte(name)
+	return outFrame{buf: &b}
+}
+
+// drain pops everything left in q and returns the frame names in order.
+func drain(q *frameQueue) []string {
+	var names []string
+	for {
+		b, ok := q.pop()
+		if !ok {
+			return names
+		}
+		names = append(names, string(*b.buf))
+	}
+}
+
+func pushAll(t *testing.T, q *frameQueue, prio priority, key string, names ...string) {
+	t.Helper()
+
+	for _, name := range names {
+		if err := q.push(queuedFrame(name), prio, key); err != nil {
+			t.Fatalf("push %s: %v", name, err)
+		}
+	}
+}
+
+func expectOrder(t *testing.T, got []string, want ...string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+	}
+}
+
+func TestQueueControlFirst(t *testing.T) {
+	q := newFrameQueue(16)
+	pushAll(t, q, priorityData, "a", "a1", "a2")
+	pushAll(t, q, priorityHeader, "", "h1")
+	pushAll(t, q, priorityControl, "", "c1", "c2")
+
+	expectOrder(t, drain(q), "c1", "c2", "h1", "a1", "a2")
+}
+
+func TestQueueControlOvertakes(t *testing.T) {
+	q := newFrameQueue(16)
+	pushAll(t, q, priorityData, "a", "a1", "a2", "a3")
+
+	b, _ := q.pop()
+	pushAll(t, q, priorityControl, "", "c1")
+
+	expectOrder(t, append([]string{string(*b.buf)}, drain(q)...), "a1", "c1", "a2", "a3")
+}
+
+func TestQueueHeadersBeforeData(t *testing.T) {
+	q := newFrameQueue(16)
+	pushAll(t, q, priorityData, "a", "a1")
+	pushAll(t, q, priorityHeader, "", "h1")
+	pushAll(t, q, priorityData, "b", "b1")
+	pushAll(t, q, priorityHeader, "", "h2")
+
+	expectOrder(t, drain(q), "h1", "h2", "a1", "b1")
+}
+
+func TestQueueStreamOrder(t *testing.T) {
+	q := newFrameQueue(64)
+	var popped, want []string
+	for _, n := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+		pushAll(t, q, priorityData, "a", "a"+n)
+		pushAll(t, q, priorityData, "b", "b"+n)
+		want = append(want, "a"+n)
+		// Pop some frames while others are still arriving.
+		if b, ok := q.pop(); ok {
+			popped = append(popped, string(*b.buf))
+		}
+	}
+	popped = append(popped, drain(q)...)
+
+	var got []string
+	for _, name := range popped {
+		if name[0] == 'a' {
+			got = append(got, name)
+		}
+	}
+	expectOrder(t, got, want...)
+}
+
+func TestQueueRoundRobin(t *testing.T) {
+	q := newFrameQueue(16)
+	pushAll(t, q, priorityData, "a", "a1", "a2", "a3", "a4")
+	pushAll(t, q, priorityData, "b", "b1", "b2")
+
+	expectOrder(t, drain(q), "a1", "b1", "a2", "b2", "a3", "a4")
+
+	// A stream that empties and comes back joins the rotation again.
+	pushAll(t, q, priorityData, "a", "a5", "a6")
+	pushAll(t, q, priorityData, "b", "b3")
+	expectOrder(t, drain(q), "a5", "b3", "a6")
+}
+
+func TestQueueLimit(t *testing.T) {
+	q := newFrameQueue(2)
+	pushAll(t, q, priorityData, "a", "a1", "a2")
+
+	if err := q.push(queuedFrame("c1"), priorityControl, ""); err != ErrorQueueFull {
+		t.Fatalf("push over limit: %v", err)
+	}
+	if depth, highWater := q.depth(); depth != 2 || highWater != 2 {
+		t.Fatalf("depth %d, high water %d", depth, highWater)
+	}
+
+	q.pop()
+	if err := q.push(queuedFrame("a3"), priorityData, "a"); err != nil {
+		t.Fatalf("push after pop: %v", err)
+	}
+
+	q.close()
+	if err := q.push(queuedFrame("a4"), priorityData, "a"); err != ErrorConnectionClosed {
+		t.Fatalf("push after close: %v", err)
+	}
+	if n := q.discard(); n != 2 {
+		t.Fatalf("discarded %d frames, want 2", n)
+	}
+}
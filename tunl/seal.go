@@ -0,0 +1,439 @@
+package tunl
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"github.com/black40x/tunl-core/commands"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+	"google.golang.org/protobuf/proto"
+	"io"
+	"sync"
+)
+
+const sealVersion = 2
+
+const sealOverhead = 1 + 4 + 8 + chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+
+const maxCachedEpochs = 4
+
+const (
+	sealRequest byte = iota + 1
+	sealResponse
+	sealBody
+	sealBodyEOF
+)
+
+var (
+	ErrorInvalidKey = errors.New("invalid key")
+	ErrorNotSealed  = errors.New("message is not sealed")
+	ErrorUnseal     = errors.New("message authentication failed")
+	ErrorSealOrder  = errors.New("sealed message out of order")
+)
+
+type KeyPair struct {
+	Public  [32]byte
+	Private [32]byte
+}
+
+func GenerateKeyPair() (*KeyPair, error) {
+	k := &KeyPair{}
+	if _, err := io.ReadFull(rand.Reader, k.Private[:]); err != nil {
+		return nil, err
+	}
+
+	pub, err := curve25519.X25519(k.Private[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	copy(k.Public[:], pub)
+
+	return k, nil
+}
+
+func (k *KeyPair) PublicKeyString() string {
+	return base64.RawURLEncoding.EncodeToString(k.Public[:])
+}
+
+func ParsePublicKey(s string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) != curve25519.PointSize {
+		return nil, ErrorInvalidKey
+	}
+	return b, nil
+}
+
+// Sealer encrypts request and response headers and body chunks between the
+// owner of a public endpoint and the client, so the tunnel server in the
+// middle only relays opaque bytes. Each direction uses its own key, and
+// Rotate moves outgoing messages to a fresh key; the epoch travels with
+// every sealed message so the peer follows along.
+//
+// Messages of a stream are numbered per direction, starting with the
+// request or response header, and must be opened in the order they were
+// sealed, so the server can neither drop, repeat nor reorder them. The
+// numbering of a stream is released by its EOF chunk, or by EndStream for
+// streams that end without one.
+type Sealer struct {
+	secret    []byte
+	localKey  []byte
+	remoteKey []byte
+
+	mu        sync.Mutex
+	epoch     uint32
+	sendAEAD  cipher.AEAD
+	recvAEADs map[uint32]cipher.AEAD
+	sendSeq   map[string]uint64
+	recvSeq   map[string]uint64
+}
+
+func NewSealer(local *KeyPair, remotePublic []byte) (*Sealer, error) {
+	if local == nil || len(remotePublic) != curve25519.PointSize {
+		return nil, ErrorInvalidKey
+	}
+
+	secret, err := curve25519.X25519(local.Private[:], remotePublic)
+	if err != nil {
+		return nil, ErrorInvalidKey
+	}
+
+	s := &Sealer{
+		secret:    secret,
+		localKey:  append([]byte(nil), local.Public[:]...),
+		remoteKey: append([]byte(nil), remotePublic...),
+		recvAEADs: make(map[uint32]cipher.AEAD),
+		sendSeq:   make(map[string]uint64),
+		recvSeq:   make(map[string]uint64),
+	}
+	s.sendAEAD, err = s.deriveAEAD(s.localKey, s.remoteKey, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Sealer) deriveAEAD(from, to []byte, epoch uint32) (cipher.AEAD, error) {
+	info := make([]byte, 0, 16+len(from)+len(to))
+	info = append(info, "tunl e2e"...)
+	info = binary.BigEndian.AppendUint32(info, epoch)
+	info = append(info, from...)
+	info = append(info, to...)
+
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, s.secret, nil, info), key); err != nil {
+		return nil, err
+	}
+
+	return chacha20poly1305.NewX(key)
+}
+
+func (s *Sealer) Epoch() uint32 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.epoch
+}
+
+// Rotate switches outgoing messages to the key of the next epoch.
+func (s *Sealer) Rotate() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	aead, err := s.deriveAEAD(s.localKey, s.remoteKey, s.epoch+1)
+	if err != nil {
+		return err
+	}
+	s.epoch++
+	s.sendAEAD = aead
+
+	return nil
+}
+
+func (s *Sealer) recvAEAD(epoch uint32) (cipher.AEAD, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if aead, ok := s.recvAEADs[epoch]; ok {
+		return aead, nil
+	}
+
+	aead, err := s.deriveAEAD(s.remoteKey, s.localKey, epoch)
+	if err != nil {
+		return nil, err
+	}
+	if len(s.recvAEADs) >= maxCachedEpochs {
+		oldest := epoch
+		for e := range s.recvAEADs {
+			if e < oldest {
+				oldest = e
+			}
+		}
+		delete(s.recvAEADs, oldest)
+	}
+	s.recvAEADs[epoch] = aead
+
+	return aead, nil
+}
+
+// EndStream forgets the message numbering of a stream in both directions.
+func (s *Sealer) EndStream(uuid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.sendSeq, uuid)
+	delete(s.recvSeq, uuid)
+}
+
+// additionalData binds a sealed message to its kind, stream and position in
+// the stream, plus the unsealed fields that travel next to it.
+func additionalData(kind byte, uuid string, seq uint64, fields ...[]byte) []byte {
+	ad := make([]byte, 0, 16+len(uuid))
+	ad = append(ad, sealVersion, kind)
+	ad = binary.BigEndian.AppendUint64(ad, seq)
+	ad = binary.BigEndian.AppendUint32(ad, uint32(len(uuid)))
+	ad = append(ad, uuid...)
+	for _, f := range fields {
+		ad = binary.BigEndian.AppendUint32(ad, uint32(len(f)))
+		ad = append(ad, f...)
+	}
+	return ad
+}
+
+// seal encrypts plaintext as the next message of the stream. The result is
+// version, epoch, sequence number, nonce and ciphertext.
+func (s *Sealer) seal(kind byte, uuid string, plaintext []byte, fields ...[]byte) ([]byte, error) {
+	s.mu.Lock()
+	epoch, aead, seq := s.epoch, s.sendAEAD, s.sendSeq[uuid]
+	if kind == sealBodyEOF {
+		delete(s.sendSeq, uuid)
+	} else {
+		s.sendSeq[uuid] = seq + 1
+	}
+	s.mu.Unlock()
+
+	out := make([]byte, 13+aead.NonceSize(), sealOverhead+len(plaintext))
+	out[0] = sealVersion
+	binary.BigEndian.PutUint32(out[1:5], epoch)
+	binary.BigEndian.PutUint64(out[5:13], seq)
+	nonce := out[13:]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(out, nonce, plaintext, additionalData(kind, uuid, seq, fields...)), nil
+}
+
+func (s *Sealer) open(kind byte, uuid string, sealed []byte, fields ...[]byte) ([]byte, error) {
+	if len(sealed) < sealOverhead || sealed[0] != sealVersion {
+		return nil, ErrorUnseal
+	}
+
+	seq := binary.BigEndian.Uint64(sealed[5:13])
+	s.mu.Lock()
+	next := s.recvSeq[uuid]
+	s.mu.Unlock()
+	if seq != next {
+		return nil, ErrorSealOrder
+	}
+
+	aead, err := s.recvAEAD(binary.BigEndian.Uint32(sealed[1:5]))
+	if err != nil {
+		return nil, err
+	}
+	nonce := sealed[13 : 13+aead.NonceSize()]
+
+	plaintext, err := aead.Open(nil, nonce, sealed[13+aead.NonceSize():], additionalData(kind, uuid, seq, fields...))
+	if err != nil {
+		return nil, ErrorUnseal
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.recvSeq[uuid] != seq {
+		return nil, ErrorSealOrder
+	}
+	if kind == sealBodyEOF {
+		delete(s.recvSeq, uuid)
+	} else {
+		s.recvSeq[uuid] = seq + 1
+	}
+
+	return plaintext, nil
+}
+
+func requestFields(r *commands.HttpRequest) [][]byte {
+	return [][]byte{[]byte(r.GetMethod()), []byte(r.GetUri())}
+}
+
+func responseFields(r *commands.HttpResponse) [][]byte {
+	return [][]byte{binary.BigEndian.AppendUint32(nil, uint32(r.GetStatus()))}
+}
+
+// SealRequest returns a copy of r with its headers and cookies encrypted.
+// The method and URI stay readable but cannot be changed without the peer
+// noticing.
+func (s *Sealer) SealRequest(r *commands.HttpRequest) (*commands.HttpRequest, error) {
+	plain, err := proto.Marshal(&commands.HttpRequest{Header: r.Header, Cookies: r.Cookies})
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.seal(sealRequest, r.GetUuid(), plain, requestFields(r)...)
+	if err != nil {
+		return nil, err
+	}
+
+	c := proto.Clone(r).(*commands.HttpRequest)
+	c.Header, c.Cookies, c.Sealed = nil, nil, sealed
+
+	return c, nil
+}
+
+// OpenRequest restores the headers and cookies of a sealed request in place.
+func (s *Sealer) OpenRequest(r *commands.HttpRequest) error {
+	if len(r.GetSealed()) == 0 {
+		return ErrorNotSealed
+	}
+	plain, err := s.open(sealRequest, r.GetUuid(), r.GetSealed(), requestFields(r)...)
+	if err != nil {
+		return err
+	}
+
+	h := &commands.HttpRequest{}
+	if err = proto.Unmarshal(plain, h); err != nil {
+		return err
+	}
+	r.Header, r.Cookies, r.Sealed = h.Header, h.Cookies, nil
+
+	return nil
+}
+
+// SealResponse returns a copy of r with its headers encrypted and its status
+// bound to them.
+func (s *Sealer) SealResponse(r *commands.HttpResponse) (*commands.HttpResponse, error) {
+	plain, err := proto.Marshal(&commands.HttpResponse{Header: r.Header})
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := s.seal(sealResponse, r.GetUuid(), plain, responseFields(r)...)
+	if err != nil {
+		return nil, err
+	}
+
+	c := proto.Clone(r).(*commands.HttpResponse)
+	c.Header, c.Sealed = nil, sealed
+
+	return c, nil
+}
+
+// OpenResponse restores the headers of a sealed response in place.
+func (s *Sealer) OpenResponse(r *commands.HttpResponse) error {
+	if len(r.GetSealed()) == 0 {
+		return ErrorNotSealed
+	}
+	plain, err := s.open(sealResponse, r.GetUuid(), r.GetSealed(), responseFields(r)...)
+	if err != nil {
+		return err
+	}
+
+	h := &commands.HttpResponse{}
+	if err = proto.Unmarshal(plain, h); err != nil {
+		return err
+	}
+	r.Header, r.Sealed = h.Header, nil
+
+	return nil
+}
+
+func chunkKind(c *commands.BodyChunk) byte {
+	if c.GetEof() {
+		return sealBodyEOF
+	}
+	return sealBody
+}
+
+// SealChunk returns a copy of c with its body encrypted.
+func (s *Sealer) SealChunk(c *commands.BodyChunk) (*commands.BodyChunk, error) {
+	sealed, err := s.seal(chunkKind(c), c.GetUuid(), c.GetBody())
+	if err != nil {
+		return nil, err
+	}
+
+	return &commands.BodyChunk{
+		Uuid:   c.GetUuid(),
+		Body:   sealed,
+		Eof:    c.GetEof(),
+		Sealed: true,
+	}, nil
+}
+
+// OpenChunk decrypts the body of a sealed chunk in place.
+func (s *Sealer) OpenChunk(c *commands.BodyChunk) error {
+	if !c.GetSealed() {
+		return ErrorNotSealed
+	}
+	plain, err := s.open(chunkKind(c), c.GetUuid(), c.GetBody())
+	if err != nil {
+		return err
+	}
+	c.Body, c.Sealed = plain, false
+
+	return nil
+}
+
+func (s *Sealer) sealMessage(m proto.Message) (proto.Message, error) {
+	switch m := m.(type) {
+	case *commands.HttpRequest:
+		return s.SealRequest(m)
+	case *commands.HttpResponse:
+		return s.SealResponse(m)
+	case *commands.BodyChunk:
+		return s.SealChunk(m)
+	}
+	return m, nil
+}
+
+// release gives back the number of a message returned by sealMessage that
+// was never sent, so the next message of its stream takes its place. It is
+// only correct while no later message of the stream has been sealed.
+func (s *Sealer) release(m proto.Message) {
+	var uuid string
+	var sealed []byte
+	switch m := m.(type) {
+	case *commands.HttpRequest:
+		uuid, sealed = m.GetUuid(), m.GetSealed()
+	case *commands.HttpResponse:
+		uuid, sealed = m.GetUuid(), m.GetSealed()
+	case *commands.BodyChunk:
+		uuid, sealed = m.GetUuid(), m.GetBody()
+	}
+	if len(sealed) < sealOverhead {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if seq := binary.BigEndian.Uint64(sealed[5:13]); seq > 0 {
+		s.sendSeq[uuid] = seq
+	} else {
+		delete(s.sendSeq, uuid)
+	}
+}
+
+func (s *Sealer) openTransfer(trans *commands.Transfer) error {
+	switch c := trans.Command.(type) {
+	case *commands.Transfer_HttpRequest:
+		return s.OpenRequest(c.HttpRequest)
+	case *commands.Transfer_HttpResponse:
+		return s.OpenResponse(c.HttpResponse)
+	case *commands.Transfer_BodyChunk:
+		return s.OpenChunk(c.BodyChunk)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+package tunl_test
+
+import (
+	"github.com/black40x/tunl-core/commands"
+	"github.com/black40x/tunl-core/tunl"
+	"google.golang.org/protobuf/proto"
+	"sync"
+	"testing"
+)
+
+func sealerPair(t *testing.T) (a, b *tunl.Sealer) {
+	t.Helper()
+
+	ka, err := tunl.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, err := tunl.GenerateKeyPair()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a, err = tunl.NewSealer(ka, kb.Public[:]); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = tunl.NewSealer(kb, ka.Public[:]); err != nil {
+		t.Fatal(err)
+	}
+
+	return a, b
+}
+
+func sealChunks(t *testing.T, s *tunl.Sealer, uuid string, n int) []*commands.BodyChunk {
+	t.Helper()
+
+	chunks := make([]*commands.BodyChunk, n)
+	for i := range chunks {
+		c, err := s.SealChunk(&commands.BodyChunk{Uuid: uuid, Body: []byte{byte(i)}, Eof: i == n-1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks[i] = c
+	}
+
+	return chunks
+}
+
+func TestSealStreamOrder(t *testing.T) {
+	a, b := sealerPair(t)
+
+	for _, c := range sealChunks(t, a, "s", 3) {
+		if err := b.OpenChunk(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A finished stream starts over at zero.
+	for _, c := range sealChunks(t, a, "s", 2) {
+		if err := b.OpenChunk(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestSealRejectsReorder(t *testing.T) {
+	a, b := sealerPair(t)
+	chunks := sealChunks(t, a, "s", 3)
+
+	if err := b.OpenChunk(chunks[1]); err != tunl.ErrorSealOrder {
+		t.Fatalf("reordered chunk: %v", err)
+	}
+	if err := b.OpenChunk(chunks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.OpenChunk(chunks[2]); err != tunl.ErrorSealOrder {
+		t.Fatalf("dropped chunk: %v", err)
+	}
+}
+
+func TestSealRejectsDuplicate(t *testing.T) {
+	a, b := sealerPair(t)
+	chunks := sealChunks(t, a, "s", 2)
+
+	dup := &commands.BodyChunk{Uuid: "s", Body: chunks[0].Body, Sealed: true}
+	if err := b.OpenChunk(chunks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.OpenChunk(dup); err != tunl.ErrorSealOrder {
+		t.Fatalf("duplicated chunk: %v", err)
+	}
+}
+
+func TestSealRejectsEarlyEOF(t *testing.T) {
+	a, b := sealerPair(t)
+	chunks := sealChunks(t, a, "s", 3)
+
+	chunks[1].Eof = true
+	if err := b.OpenChunk(chunks[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.OpenChunk(chunks[1]); err != tunl.ErrorUnseal {
+		t.Fatalf("truncated stream: %v", err)
+	}
+}
+
+func TestSealBindsRequestLine(t *testing.T) {
+	a, b := sealerPair(t)
+
+	req, err := a.SealRequest(&commands.HttpRequest{Uuid: "r", Method: "GET", Uri: "/a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Uri = "/admin"
+	if err = b.OpenRequest(req); err != tunl.ErrorUnseal {
+		t.Fatalf("rewritten URI: %v", err)
+	}
+	req.Uri, req.Method = "/a", "DELETE"
+	if err = b.OpenRequest(req); err != tunl.ErrorUnseal {
+		t.Fatalf("rewritten method: %v", err)
+	}
+	req.Method = "GET"
+	if err = b.OpenRequest(req); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := b.SealResponse(&commands.HttpResponse{Uuid: "r", Status: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Status = 302
+	if err = a.OpenResponse(resp); err != tunl.ErrorUnseal {
+		t.Fatalf("rewritten status: %v", err)
+	}
+	resp.Status = 200
+	if err = a.OpenResponse(resp); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealEndStream(t *testing.T) {
+	a, b := sealerPair(t)
+
+	req, err := a.SealRequest(&commands.HttpRequest{Uuid: "r", Method: "GET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = b.OpenRequest(req); err != nil {
+		t.Fatal(err)
+	}
+	a.EndStream("r")
+	b.EndStream("r")
+
+	if req, err = a.SealRequest(&commands.HttpRequest{Uuid: "r", Method: "GET"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.OpenRequest(req); err != nil {
+		t.Fatalf("reused stream: %v", err)
+	}
+}
+
+// openNext reads the next frame from tr and opens it as a sealed chunk.
+func openNext(t *testing.T, tr tunl.Transport, s *tunl.Sealer) *commands.BodyChunk {
+	t.Helper()
+
+	f, err := tr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trans := &commands.Transfer{}
+	if err = proto.Unmarshal(f.Payload, trans); err != nil {
+		t.Fatal(err)
+	}
+	c := trans.GetBodyChunk()
+	if err = s.OpenChunk(c); err != nil {
+		t.Fatalf("open chunk: %v", err)
+	}
+
+	return c
+}
+
+func TestSealDroppedFrame(t *testing.T) {
+	a, b := sealerPair(t)
+	cfg := tunl.DefaultConfig()
+	cfg.SendQueueSize = 1
+	cfg.SendQueuePolicy = tunl.QueueDrop
+	local, remote := tunl.Pipe()
+	c := tunl.NewTunlConnTransport(local, cfg)
+	defer c.Close()
+	defer remote.Close()
+	c.SetSealer(a)
+
+	if _, err := c.Send(&commands.BodyChunk{Uuid: "s", Body: []byte{0}}); err != nil {
+		t.Fatal(err)
+	}
+	waitStats(t, c, func(s tunl.Stats) bool { return s.QueueDepth == 0 })
+	if _, err := c.Send(&commands.BodyChunk{Uuid: "s", Body: []byte{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Send(&commands.BodyChunk{Uuid: "s", Body: []byte{2}}); err != tunl.ErrorQueueFull {
+		t.Fatalf("Send on full queue: %v", err)
+	}
+
+	openNext(t, remote, b)
+	openNext(t, remote, b)
+
+	// The dropped chunk's number goes to the next one, so the stream stays
+	// in step.
+	if _, err := c.Send(&commands.BodyChunk{Uuid: "s", Body: []byte{2}, Eof: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := openNext(t, remote, b); got.GetBody()[0] != 2 {
+		t.Fatalf("got chunk %v", got.GetBody())
+	}
+}
+
+func TestSealConcurrentSend(t *testing.T) {
+	a, b := sealerPair(t)
+	local, remote := tunl.Pipe()
+	c := tunl.NewTunlConnTransport(local, nil)
+	defer c.Close()
+	defer remote.Close()
+	c.SetSealer(a)
+
+	const senders, chunks = 4, 50
+	var wg sync.WaitGroup
+	wg.Add(senders)
+	for i := 0; i < senders; i++ {
+		go func() {
+			defer wg.Done()
+			for j := 0; j < chunks; j++ {
+				if _, err := c.Send(&commands.BodyChunk{Uuid: "s", Body: []byte{byte(j)}}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < senders*chunks; i++ {
+		openNext(t, remote, b)
+	}
+	wg.Wait()
+}
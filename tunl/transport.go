@@ -0,0 +1,187 @@
+package tunl
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+var ErrorInvalidFrame = errors.New("invalid frame")
+
+const (
+	// FramePrefixSize is the length of the prefix in front of every frame on
+	// a byte stream.
+	FramePrefixSize = 4
+	// FrameCompressed is the prefix bit that marks a compressed payload.
+	FrameCompressed = 1 << 31
+)
+
+type Frame struct {
+	Payload    []byte
+	Compressed bool
+}
+
+// Transport carries frames between two peers. ReadFrame and WriteFrame are
+// each called from a single goroutine; the payload returned by ReadFrame is
+// only valid until the next call, and WriteFrame must not keep the payload
+// it is given.
+type Transport interface {
+	ReadFrame() (Frame, error)
+	WriteFrame(f Frame) error
+	Close() error
+}
+
+// Flusher is implemented by transports that buffer written frames.
+type Flusher interface {
+	Flush() error
+}
+
+type deadlineWriter interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// StreamTransport frames messages on a byte stream with a 4-byte big-endian
+// prefix holding the frame length, prefix included. The top bit of the
+// prefix marks a compressed payload.
+type StreamTransport struct {
+	rw      io.ReadWriteCloser
+	r       *bufio.Reader
+	w       *bufio.Writer
+	rhead   [FramePrefixSize]byte
+	whead   [FramePrefixSize]byte
+	buf     *[]byte
+	maxSize int
+}
+
+func NewStreamTransport(rw io.ReadWriteCloser, cfg *Config) *StreamTransport {
+	cfg = cfg.withDefaults()
+	return &StreamTransport{
+		rw:      rw,
+		r:       bufio.NewReaderSize(rw, cfg.ReadBufferSize),
+		w:       bufio.NewWriterSize(rw, cfg.WriteBufferSize),
+		maxSize: cfg.MaxFrameSize,
+	}
+}
+
+func (s *StreamTransport) ReadFrame() (Frame, error) {
+	_, err := io.ReadFull(s.r, s.rhead[:])
+	if err != nil {
+		return Frame{}, err
+	}
+
+	header := binary.BigEndian.Uint32(s.rhead[:])
+	size := int(header&^FrameCompressed) - FramePrefixSize
+	if size < 0 {
+		return Frame{}, ErrorInvalidFrame
+	}
+	if size > s.maxSize {
+		return Frame{}, ErrorFrameTooLarge
+	}
+
+	if s.buf == nil || cap(*s.buf) < size || (cap(*s.buf) > bufferClasses[2] && size <= bufferClasses[2]) {
+		s.release()
+		s.buf = getBuffer(size)
+	}
+	data := (*s.buf)[:size]
+
+	_, err = io.ReadFull(s.r, data)
+	if err != nil {
+		return Frame{}, err
+	}
+
+	return Frame{Payload: data, Compressed: header&FrameCompressed != 0}, nil
+}
+
+func (s *StreamTransport) WriteFrame(f Frame) error {
+	header := uint32(FramePrefixSize + len(f.Payload))
+	if f.Compressed {
+		header |= FrameCompressed
+	}
+	binary.BigEndian.PutUint32(s.whead[:], header)
+
+	if _, err := s.w.Write(s.whead[:]); err != nil {
+		return err
+	}
+	_, err := s.w.Write(f.Payload)
+	return err
+}
+
+func (s *StreamTransport) Flush() error {
+	return s.w.Flush()
+}
+
+func (s *StreamTransport) SetWriteDeadline(t time.Time) error {
+	if d, ok := s.rw.(deadlineWriter); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+func (s *StreamTransport) Close() error {
+	return s.rw.Close()
+}
+
+// release hands the read buffer back to the pool. It must only be called by
+// the reading goroutine once it is done with the transport.
+func (s *StreamTransport) release() {
+	if s.buf != nil {
+		putBuffer(s.buf)
+		s.buf = nil
+	}
+}
+
+type pipeTransport struct {
+	in        <-chan Frame
+	out       chan<- Frame
+	done      chan struct{}
+	closeOnce *sync.Once
+}
+
+// Pipe returns two connected in-memory transports. Like net.Pipe, every
+// write blocks until the other side reads it, and closing either end closes
+// both.
+func Pipe() (Transport, Transport) {
+	ab := make(chan Frame)
+	ba := make(chan Frame)
+	done := make(chan struct{})
+	once := &sync.Once{}
+
+	return &pipeTransport{in: ba, out: ab, done: done, closeOnce: once},
+		&pipeTransport{in: ab, out: ba, done: done, closeOnce: once}
+}
+
+func (p *pipeTransport) ReadFrame() (Frame, error) {
+	select {
+	case f := <-p.in:
+		return f, nil
+	case <-p.done:
+		return Frame{}, io.EOF
+	}
+}
+
+func (p *pipeTransport) WriteFrame(f Frame) error {
+	f.Payload = append([]byte(nil), f.Payload...)
+
+	select {
+	case <-p.done:
+		return io.ErrClosedPipe
+	default:
+	}
+
+	select {
+	case p.out <- f:
+		return nil
+	case <-p.done:
+		return io.ErrClosedPipe
+	}
+}
+
+func (p *pipeTransport) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.done)
+	})
+	return nil
+}
@@ -0,0 +1,156 @@
+package tunl_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"github.com/black40x/tunl-core/tunl"
+	"io"
+	"testing"
+	"time"
+)
+
+// bufferConn is a byte stream backed by a buffer, so tests can look at
+// exactly what a StreamTransport wrote.
+type bufferConn struct {
+	bytes.Buffer
+}
+
+func (*bufferConn) Close() error { return nil }
+
+func streamWith(b []byte, maxSize int) *tunl.StreamTransport {
+	cfg := tunl.DefaultConfig()
+	cfg.MaxFrameSize = maxSize
+	conn := &bufferConn{}
+	conn.Write(b)
+	return tunl.NewStreamTransport(conn, cfg)
+}
+
+func TestStreamTransportRoundTrip(t *testing.T) {
+	frames := []tunl.Frame{
+		{Payload: []byte("hello")},
+		{Payload: []byte{}},
+		{Payload: bytes.Repeat([]byte{7}, 1000), Compressed: true},
+	}
+
+	conn := &bufferConn{}
+	tr := tunl.NewStreamTransport(conn, nil)
+	for _, f := range frames {
+		if err := tr.WriteFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tr.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw := conn.Bytes()
+	if got := binary.BigEndian.Uint32(raw); got != tunl.FramePrefixSize+5 {
+		t.Fatalf("first prefix %#x, want the length including the prefix", got)
+	}
+	last := raw[len(raw)-tunl.FramePrefixSize-1000:]
+	if got := binary.BigEndian.Uint32(last); got != tunl.FrameCompressed|(tunl.FramePrefixSize+1000) {
+		t.Fatalf("compressed prefix %#x", got)
+	}
+
+	for i, want := range frames {
+		got, err := tr.ReadFrame()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if !bytes.Equal(got.Payload, want.Payload) || got.Compressed != want.Compressed {
+			t.Fatalf("frame %d: got %d bytes compressed=%v, want %d bytes compressed=%v",
+				i, len(got.Payload), got.Compressed, len(want.Payload), want.Compressed)
+		}
+	}
+	if _, err := tr.ReadFrame(); err != io.EOF {
+		t.Fatalf("after last frame: %v", err)
+	}
+}
+
+func TestStreamTransportBadPrefix(t *testing.T) {
+	const maxSize = 16
+
+	tests := []struct {
+		name   string
+		prefix uint32
+		err    error
+	}{
+		{"empty", tunl.FramePrefixSize, nil},
+		{"short", tunl.FramePrefixSize - 1, tunl.ErrorInvalidFrame},
+		{"zero", 0, tunl.ErrorInvalidFrame},
+		{"short compressed", tunl.FrameCompressed | 2, tunl.ErrorInvalidFrame},
+		{"max", tunl.FramePrefixSize + maxSize, nil},
+		{"too large", tunl.FramePrefixSize + maxSize + 1, tunl.ErrorFrameTooLarge},
+		{"too large compressed", tunl.FrameCompressed | (tunl.FramePrefixSize + maxSize + 1), tunl.ErrorFrameTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := binary.BigEndian.AppendUint32(nil, tt.prefix)
+			b = append(b, make([]byte, maxSize+1)...)
+
+			_, err := streamWith(b, maxSize).ReadFrame()
+			if err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestStreamTransportTruncated(t *testing.T) {
+	b := binary.BigEndian.AppendUint32(nil, tunl.FramePrefixSize+10)
+	b = append(b, "short"...)
+
+	if _, err := streamWith(b, 16).ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated payload: %v", err)
+	}
+	if _, err := streamWith([]byte{0, 0}, 16).ReadFrame(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated prefix: %v", err)
+	}
+}
+
+func TestPipe(t *testing.T) {
+	a, b := tunl.Pipe()
+	defer a.Close()
+
+	payload := []byte("frame")
+	go a.WriteFrame(tunl.Frame{Payload: payload, Compressed: true})
+
+	f, err := b.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload[0] = 'X'
+	if string(f.Payload) != "frame" || !f.Compressed {
+		t.Fatalf("got %q compressed=%v", f.Payload, f.Compressed)
+	}
+}
+
+func TestPipeCloseUnblocksRead(t *testing.T) {
+	a, b := tunl.Pipe()
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := b.ReadFrame()
+		read <- err
+	}()
+
+	select {
+	case err := <-read:
+		t.Fatalf("ReadFrame returned early: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	a.Close()
+	select {
+	case err := <-read:
+		if err != io.EOF {
+			t.Fatalf("pending ReadFrame: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadFrame still blocked after Close")
+	}
+
+	if err := b.WriteFrame(tunl.Frame{Payload: []byte("late")}); err != io.ErrClosedPipe {
+		t.Fatalf("WriteFrame after Close: %v", err)
+	}
+}
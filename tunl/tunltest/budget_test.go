@@ -0,0 +1,17 @@
+package tunltest
+
+import "testing"
+
+func TestFaultConnSpentBudget(t *testing.T) {
+	c := NewFaultConn(nil, Faults{DisconnectAfter: 4})
+
+	for _, spent := range []int64{0, 3, 4, 10} {
+		// A concurrent Read and Write can both pass before and together go
+		// over the limit.
+		c.bytes = spent
+		want := int(max(4-spent, 0))
+		if n := c.budget(8); n != want {
+			t.Errorf("budget(8) after %d bytes = %d, want %d", spent, n, want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package tunltest
+
+import (
+	"sync"
+	"time"
+)
+
+// FakeClock is a tunl.Clock that only moves when told to.
+type FakeClock struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []waiter
+}
+
+type waiter struct {
+	at time.Time
+	c  chan time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	c := &FakeClock{now: now}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+
+	c.waiters = append(c.waiters, waiter{at: c.now.Add(d), c: ch})
+	c.cond.Broadcast()
+
+	return ch
+}
+
+// Advance moves the clock forward and fires every timer that became due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+func (c *FakeClock) Set(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = now
+	pending := c.waiters[:0]
+	for _, w := range c.waiters {
+		if w.at.After(now) {
+			pending = append(pending, w)
+			continue
+		}
+		w.c <- now
+	}
+	c.waiters = pending
+}
+
+// Waiters returns the number of timers that have not fired yet.
+func (c *FakeClock) Waiters() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.waiters)
+}
+
+// BlockUntil waits until at least n timers are pending, which lets a test
+// advance the clock only once the code under test is waiting on it.
+func (c *FakeClock) BlockUntil(n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for len(c.waiters) < n {
+		c.cond.Wait()
+	}
+}
@@ -0,0 +1,80 @@
+package tunltest_test
+
+import (
+	"github.com/black40x/tunl-core/tunl"
+	"github.com/black40x/tunl-core/tunl/tunltest"
+	"testing"
+	"time"
+)
+
+var _ tunl.Clock = (*tunltest.FakeClock)(nil)
+
+func fired(c <-chan time.Time) bool {
+	select {
+	case <-c:
+		return true
+	default:
+		return false
+	}
+}
+
+func TestFakeClockAdvance(t *testing.T) {
+	start := time.Unix(1000, 0)
+	clock := tunltest.NewFakeClock(start)
+
+	short := clock.After(time.Second)
+	long := clock.After(time.Minute)
+	if n := clock.Waiters(); n != 2 {
+		t.Fatalf("%d waiters, want 2", n)
+	}
+
+	clock.Advance(999 * time.Millisecond)
+	if fired(short) || fired(long) {
+		t.Fatal("timer fired early")
+	}
+
+	clock.Advance(time.Millisecond)
+	if !fired(short) {
+		t.Fatal("timer did not fire when due")
+	}
+	if fired(long) || clock.Waiters() != 1 {
+		t.Fatal("later timer fired too")
+	}
+	if got := clock.Now(); !got.Equal(start.Add(time.Second)) {
+		t.Fatalf("Now() = %v", got)
+	}
+
+	clock.Set(start.Add(time.Hour))
+	if !fired(long) || clock.Waiters() != 0 {
+		t.Fatal("Set did not fire the remaining timer")
+	}
+}
+
+func TestFakeClockAfterZero(t *testing.T) {
+	clock := tunltest.NewFakeClock(time.Unix(1000, 0))
+
+	if !fired(clock.After(0)) {
+		t.Fatal("After(0) did not fire at once")
+	}
+	if n := clock.Waiters(); n != 0 {
+		t.Fatalf("%d waiters, want 0", n)
+	}
+}
+
+func TestFakeClockBlockUntil(t *testing.T) {
+	clock := tunltest.NewFakeClock(time.Unix(1000, 0))
+
+	done := make(chan struct{})
+	go func() {
+		<-clock.After(time.Second)
+		close(done)
+	}()
+
+	clock.BlockUntil(1)
+	clock.Advance(time.Second)
+	select {
+	case <-done:
+	case <-time.After(tunltest.DefaultTimeout):
+		t.Fatal("waiting goroutine never woke up")
+	}
+}
@@ -0,0 +1,258 @@
+package tunltest
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/black40x/tunl-core/tunl"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrorInjectedDisconnect = errors.New("injected disconnect")
+
+// Faults describes what a FaultConn does to the traffic passing through it.
+// The same Seed always produces the same sequence of faults for the same
+// sequence of calls.
+type Faults struct {
+	Seed int64
+	// Latency delays every Read and Write, plus a random amount up to
+	// Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+	// Bandwidth limits writes to that many bytes per second. Zero means
+	// unlimited.
+	Bandwidth int
+	// PartialWrites splits every write into several smaller writes.
+	PartialWrites bool
+	// ShortReads makes reads return fewer bytes than asked for.
+	ShortReads bool
+	// DisconnectProbability is the chance of closing the connection on any
+	// Read or Write.
+	DisconnectProbability float64
+	// DisconnectAfter closes the connection once that many bytes have been
+	// written or read. Zero disables it.
+	DisconnectAfter int64
+	// CorruptPrefixProbability is the chance of replacing the length prefix
+	// of a frame, in either direction, with a bogus value.
+	CorruptPrefixProbability float64
+}
+
+// FaultConn wraps a net.Conn carrying tunl frames and injects the faults
+// described by Faults.
+type FaultConn struct {
+	net.Conn
+	faults Faults
+
+	mu       sync.Mutex
+	rnd      *rand.Rand
+	bytes    int64
+	closed   bool
+	inbound  frameTracker
+	outbound frameTracker
+}
+
+func NewFaultConn(conn net.Conn, f Faults) *FaultConn {
+	return &FaultConn{
+		Conn:   conn,
+		faults: f,
+		rnd:    rand.New(rand.NewSource(f.Seed)),
+	}
+}
+
+// NewFaultPeer is NewPeer with the faults applied to the connection under
+// test, so its reads and writes both go through the FaultConn.
+func NewFaultPeer(cfg *tunl.Config, f Faults) (*tunl.TunlConn, *Peer) {
+	a, b := net.Pipe()
+	return tunl.NewTunlConnConfig(NewFaultConn(a, f), cfg), &Peer{
+		Conn:      b,
+		Timeout:   DefaultTimeout,
+		transport: tunl.NewStreamTransport(b, nil),
+	}
+}
+
+var bogusPrefixes = []uint32{0, 1, tunl.FramePrefixSize - 1, 0x7fffffff, 0xffffffff}
+
+func (c *FaultConn) bogusPrefix() uint32 {
+	if c.rnd.Intn(2) == 0 {
+		return bogusPrefixes[c.rnd.Intn(len(bogusPrefixes))]
+	}
+	return c.rnd.Uint32()
+}
+
+// before applies delays and decides whether the connection dies now.
+func (c *FaultConn) before() error {
+	c.mu.Lock()
+	delay := c.faults.Latency
+	if c.faults.Jitter > 0 {
+		delay += time.Duration(c.rnd.Int63n(int64(c.faults.Jitter)))
+	}
+	disconnect := c.closed ||
+		(c.faults.DisconnectProbability > 0 && c.rnd.Float64() < c.faults.DisconnectProbability) ||
+		(c.faults.DisconnectAfter > 0 && c.bytes >= c.faults.DisconnectAfter)
+	c.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if disconnect {
+		c.disconnect()
+		return ErrorInjectedDisconnect
+	}
+
+	return nil
+}
+
+func (c *FaultConn) disconnect() {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+
+	c.Conn.Close()
+}
+
+// budget trims n to what may pass before DisconnectAfter is reached. A
+// concurrent Read or Write may already have used up more than the limit
+// since before ran, so the result can be zero.
+func (c *FaultConn) budget(n int) int {
+	if c.faults.DisconnectAfter > 0 {
+		if left := max(c.faults.DisconnectAfter-c.bytes, 0); int64(n) > left {
+			n = int(left)
+		}
+	}
+	return n
+}
+
+func (c *FaultConn) Read(b []byte) (int, error) {
+	if err := c.before(); err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	size := c.budget(len(b))
+	if c.faults.ShortReads && size > 1 {
+		size = 1 + c.rnd.Intn(size)
+	}
+	c.mu.Unlock()
+
+	if size == 0 && len(b) > 0 {
+		c.disconnect()
+		return 0, ErrorInjectedDisconnect
+	}
+
+	n, err := c.Conn.Read(b[:size])
+
+	c.mu.Lock()
+	c.bytes += int64(n)
+	c.corrupt(&c.inbound, b[:n])
+	c.mu.Unlock()
+
+	return n, err
+}
+
+func (c *FaultConn) Write(b []byte) (int, error) {
+	if err := c.before(); err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	size := c.budget(len(b))
+	out := append([]byte(nil), b[:size]...)
+	c.corrupt(&c.outbound, out)
+	var parts []int
+	for rest := len(out); rest > 0; {
+		n := rest
+		if c.faults.PartialWrites && n > 1 {
+			n = 1 + c.rnd.Intn(n)
+		}
+		parts = append(parts, n)
+		rest -= n
+	}
+	c.mu.Unlock()
+
+	written := 0
+	for _, n := range parts {
+		if c.faults.Bandwidth > 0 {
+			time.Sleep(time.Duration(n) * time.Second / time.Duration(c.faults.Bandwidth))
+		}
+		w, err := c.Conn.Write(out[written : written+n])
+		written += w
+
+		c.mu.Lock()
+		c.bytes += int64(w)
+		c.mu.Unlock()
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	if size < len(b) {
+		c.disconnect()
+		return written, ErrorInjectedDisconnect
+	}
+
+	return written, nil
+}
+
+func (c *FaultConn) corrupt(t *frameTracker, b []byte) {
+	if c.faults.CorruptPrefixProbability <= 0 {
+		t.walk(b, nil)
+		return
+	}
+	t.walk(b, func() (uint32, bool) {
+		if c.rnd.Float64() < c.faults.CorruptPrefixProbability {
+			return c.bogusPrefix(), true
+		}
+		return 0, false
+	})
+}
+
+// frameTracker follows frame boundaries in a byte stream so that length
+// prefixes can be rewritten as they pass. It keeps tracking the original
+// lengths, so the stream stays in step even after a prefix was corrupted.
+type frameTracker struct {
+	head    [tunl.FramePrefixSize]byte
+	n       int
+	replace []byte
+	remain  uint64
+}
+
+func (t *frameTracker) walk(b []byte, corrupt func() (uint32, bool)) {
+	for i := 0; i < len(b); {
+		if t.remain > 0 {
+			skip := uint64(len(b) - i)
+			if skip > t.remain {
+				skip = t.remain
+			}
+			i += int(skip)
+			t.remain -= skip
+			continue
+		}
+
+		if t.n == 0 {
+			t.replace = nil
+			if corrupt != nil {
+				if v, ok := corrupt(); ok {
+					t.replace = binary.BigEndian.AppendUint32(nil, v)
+				}
+			}
+		}
+
+		t.head[t.n] = b[i]
+		if t.replace != nil {
+			b[i] = t.replace[t.n]
+		}
+		t.n++
+		i++
+
+		if t.n == tunl.FramePrefixSize {
+			t.n = 0
+			length := binary.BigEndian.Uint32(t.head[:]) &^ tunl.FrameCompressed
+			if length > tunl.FramePrefixSize {
+				t.remain = uint64(length - tunl.FramePrefixSize)
+			}
+		}
+	}
+}
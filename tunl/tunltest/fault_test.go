@@ -0,0 +1,166 @@
+package tunltest_test
+
+import (
+	"bytes"
+	"github.com/black40x/tunl-core/commands"
+	"github.com/black40x/tunl-core/tunl"
+	"github.com/black40x/tunl-core/tunl/tunltest"
+	"io"
+	"net"
+	"sync"
+	"testing"
+)
+
+func TestFaultPeerShortReadsPartialWrites(t *testing.T) {
+	conn, peer := tunltest.NewFaultPeer(nil, tunltest.Faults{
+		Seed:          1,
+		ShortReads:    true,
+		PartialWrites: true,
+	})
+	defer peer.Close()
+	defer conn.Close()
+
+	rec := tunltest.NewRecorder()
+	conn.SetOnCommand(rec.Record)
+	conn.SetOnError(rec.RecordError)
+	go conn.HandleConnection()
+
+	chunks := []*commands.BodyChunk{
+		{Uuid: "a", Body: []byte("x")},
+		{Uuid: "a", Body: bytes.Repeat([]byte("body"), 1000)},
+		{Uuid: "a", Eof: true},
+	}
+	for _, c := range chunks {
+		if err := peer.Send(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, c := range chunks {
+		rec.Expect(t, c)
+	}
+
+	go func() {
+		for _, c := range chunks {
+			conn.Send(c)
+		}
+	}()
+	for _, c := range chunks {
+		peer.Expect(t, c)
+	}
+	if errs := rec.Errors(); len(errs) != 0 {
+		t.Fatalf("errors: %v", errs)
+	}
+}
+
+func TestFaultConnShortReadFrame(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	tr := tunl.NewStreamTransport(tunltest.NewFaultConn(a, tunltest.Faults{Seed: 2, ShortReads: true}), nil)
+
+	payload := bytes.Repeat([]byte("frame"), 100)
+	go b.Write(tunltest.EncodeFrame(payload, true))
+
+	f, err := tr.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.Payload, payload) || !f.Compressed {
+		t.Fatalf("got %d bytes compressed=%v", len(f.Payload), f.Compressed)
+	}
+}
+
+func TestFaultPeerCorruptPrefix(t *testing.T) {
+	conn, peer := tunltest.NewFaultPeer(nil, tunltest.Faults{
+		Seed:                     3,
+		CorruptPrefixProbability: 1,
+	})
+	defer peer.Close()
+
+	rec := tunltest.NewRecorder()
+	conn.SetOnCommand(rec.Record)
+	conn.SetOnError(rec.RecordError)
+	go conn.HandleConnection()
+
+	peer.Send(&commands.BodyChunk{Uuid: "a", Body: []byte("x")})
+
+	switch err := rec.WaitError(t, 1)[0]; err {
+	case tunl.ErrorInvalidFrame, tunl.ErrorFrameTooLarge:
+	default:
+		t.Fatalf("corrupt prefix gave %v", err)
+	}
+	if n := len(rec.Commands()); n != 0 {
+		t.Fatalf("%d commands decoded from a corrupt stream", n)
+	}
+}
+
+func TestFaultPeerDisconnectAfterRead(t *testing.T) {
+	conn, peer := tunltest.NewFaultPeer(nil, tunltest.Faults{DisconnectAfter: 100})
+	defer peer.Close()
+
+	rec := tunltest.NewRecorder()
+	conn.SetOnCommand(rec.Record)
+	conn.SetOnError(rec.RecordError)
+	go conn.HandleConnection()
+
+	chunk := &commands.BodyChunk{Uuid: "a", Body: []byte("x")}
+	peer.Send(chunk)
+	rec.Expect(t, chunk)
+
+	go peer.Send(&commands.BodyChunk{Uuid: "a", Body: make([]byte, 200)})
+	if err := rec.WaitError(t, 1)[0]; err != tunltest.ErrorInjectedDisconnect {
+		t.Fatalf("read past the limit: %v", err)
+	}
+	peer.ExpectClosed(t)
+}
+
+func TestFaultPeerDisconnectAfterWrite(t *testing.T) {
+	conn, peer := tunltest.NewFaultPeer(nil, tunltest.Faults{DisconnectAfter: 100})
+	defer peer.Close()
+
+	rec := tunltest.NewRecorder()
+	conn.SetOnError(rec.RecordError)
+
+	if _, err := conn.Send(&commands.BodyChunk{Uuid: "a", Body: make([]byte, 200)}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peer.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated frame: %v", err)
+	}
+	if err := rec.WaitError(t, 1)[0]; err != tunltest.ErrorInjectedDisconnect {
+		t.Fatalf("write past the limit: %v", err)
+	}
+}
+
+func TestFaultConnConcurrentBudget(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		a, b := net.Pipe()
+		c := tunltest.NewFaultConn(a, tunltest.Faults{Seed: seed, DisconnectAfter: 64, ShortReads: true})
+
+		go io.Copy(b, b)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				buf := make([]byte, 16)
+				for {
+					if _, err := c.Write(buf); err != nil {
+						return
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				buf := make([]byte, 16)
+				for {
+					if _, err := c.Read(buf); err != nil {
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		b.Close()
+	}
+}
@@ -0,0 +1,189 @@
+package tunltest
+
+import (
+	"encoding/binary"
+	"errors"
+	"github.com/black40x/tunl-core/commands"
+	"github.com/black40x/tunl-core/tunl"
+	"google.golang.org/protobuf/proto"
+	"net"
+	"testing"
+	"time"
+)
+
+const DefaultTimeout = 5 * time.Second
+
+// Pair returns two TunlConn connected over net.Pipe. Neither side is
+// reading yet; set the callbacks and start HandleConnection as needed.
+func Pair(cfg *tunl.Config) (client, server *tunl.TunlConn) {
+	a, b := net.Pipe()
+	return tunl.NewTunlConnConfig(a, cfg), tunl.NewTunlConnConfig(b, cfg)
+}
+
+// Peer is the raw far end of a TunlConn. It can inject arbitrary bytes,
+// including malformed frames, and decodes whatever the connection sends.
+type Peer struct {
+	Conn       net.Conn
+	Timeout    time.Duration
+	transport  *tunl.StreamTransport
+	compressor tunl.Compressor
+}
+
+// NewPeer returns a TunlConn under test connected to a Peer.
+func NewPeer(cfg *tunl.Config) (*tunl.TunlConn, *Peer) {
+	a, b := net.Pipe()
+	return tunl.NewTunlConnConfig(a, cfg), &Peer{
+		Conn:      b,
+		Timeout:   DefaultTimeout,
+		transport: tunl.NewStreamTransport(b, nil),
+	}
+}
+
+// SetCompression makes the peer compress what it sends and decompress what
+// it receives, mirroring TunlConn.SetCompression.
+func (p *Peer) SetCompression(name string) error {
+	if name == "" {
+		p.compressor = nil
+		return nil
+	}
+
+	c := tunl.GetCompressor(name)
+	if c == nil {
+		return tunl.ErrorUnknownCompression
+	}
+	p.compressor = c
+
+	return nil
+}
+
+// EncodeFrame returns payload with the length prefix used on the wire.
+func EncodeFrame(payload []byte, compressed bool) []byte {
+	frame := make([]byte, tunl.FramePrefixSize, tunl.FramePrefixSize+len(payload))
+	header := uint32(tunl.FramePrefixSize + len(payload))
+	if compressed {
+		header |= tunl.FrameCompressed
+	}
+	binary.BigEndian.PutUint32(frame, header)
+
+	return append(frame, payload...)
+}
+
+// Prefix returns a bare length prefix, handy for frames that lie about
+// their size.
+func Prefix(length uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, length)
+}
+
+// WriteRaw writes b to the connection as is.
+func (p *Peer) WriteRaw(b []byte) error {
+	p.Conn.SetWriteDeadline(time.Now().Add(p.Timeout))
+	_, err := p.Conn.Write(b)
+	return err
+}
+
+// WriteFrame writes payload as a single frame.
+func (p *Peer) WriteFrame(payload []byte) error {
+	return p.WriteRaw(EncodeFrame(payload, false))
+}
+
+func (p *Peer) Send(m proto.Message) error {
+	data, err := proto.Marshal(commands.NewTransfer(m))
+	if err != nil {
+		return err
+	}
+
+	if p.compressor != nil {
+		data, err = p.compressor.Compress(nil, data)
+		if err != nil {
+			return err
+		}
+		return p.WriteRaw(EncodeFrame(data, true))
+	}
+
+	return p.WriteFrame(data)
+}
+
+// Next returns the next command sent by the connection.
+func (p *Peer) Next() (*commands.Transfer, error) {
+	p.Conn.SetReadDeadline(time.Now().Add(p.Timeout))
+
+	f, err := p.transport.ReadFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	data := f.Payload
+	if f.Compressed {
+		if p.compressor == nil {
+			return nil, tunl.ErrorUnknownCompression
+		}
+		data, err = p.compressor.Decompress(nil, data, tunl.DefaultMaxFrameSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	trans := &commands.Transfer{}
+	if err = proto.Unmarshal(data, trans); err != nil {
+		return nil, err
+	}
+
+	return trans, nil
+}
+
+// Expect fails the test unless the next command sent equals want.
+func (p *Peer) Expect(t testing.TB, want proto.Message) *commands.Transfer {
+	t.Helper()
+
+	got, err := p.Next()
+	if err != nil {
+		t.Fatalf("expected %T: %v", want, err)
+	}
+	expectMessage(t, got, want)
+
+	return got
+}
+
+// ExpectError fails the test unless the next command sent is an Error with
+// the given code.
+func (p *Peer) ExpectError(t testing.TB, code int32) *commands.Error {
+	t.Helper()
+
+	got, err := p.Next()
+	if err != nil {
+		t.Fatalf("expected error %d: %v", code, err)
+	}
+	e := got.GetError()
+	if e == nil || e.GetCode() != code {
+		t.Fatalf("expected error %d, got %v", code, got)
+	}
+
+	return e
+}
+
+// ExpectClosed fails the test unless the connection is closed without
+// sending anything else.
+func (p *Peer) ExpectClosed(t testing.TB) {
+	t.Helper()
+
+	got, err := p.Next()
+	if err == nil {
+		t.Fatalf("expected connection to close, got %v", got)
+	}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		t.Fatalf("expected connection to close: %v", err)
+	}
+}
+
+func (p *Peer) Close() error {
+	return p.Conn.Close()
+}
+
+func expectMessage(t testing.TB, got *commands.Transfer, want proto.Message) {
+	t.Helper()
+
+	if !proto.Equal(got.Message(), want) {
+		t.Fatalf("got %v, want %v", got.Message(), want)
+	}
+}
@@ -0,0 +1,113 @@
+package tunltest_test
+
+import (
+	"bytes"
+	"github.com/black40x/tunl-core/commands"
+	"github.com/black40x/tunl-core/tunl"
+	"github.com/black40x/tunl-core/tunl/tunltest"
+	"testing"
+)
+
+func TestEncodeFrame(t *testing.T) {
+	tests := []struct {
+		payload    string
+		compressed bool
+		prefix     uint32
+	}{
+		{"", false, tunl.FramePrefixSize},
+		{"ab", false, tunl.FramePrefixSize + 2},
+		{"ab", true, tunl.FrameCompressed | (tunl.FramePrefixSize + 2)},
+	}
+	for _, tt := range tests {
+		want := append(tunltest.Prefix(tt.prefix), tt.payload...)
+		if got := tunltest.EncodeFrame([]byte(tt.payload), tt.compressed); !bytes.Equal(got, want) {
+			t.Errorf("EncodeFrame(%q, %v) = %x, want %x", tt.payload, tt.compressed, got, want)
+		}
+	}
+}
+
+func TestPair(t *testing.T) {
+	client, server := tunltest.Pair(nil)
+	defer client.Close()
+	defer server.Close()
+
+	rec := tunltest.NewRecorder()
+	server.SetOnCommand(rec.Record)
+	go server.HandleConnection()
+	go client.HandleConnection()
+
+	if _, err := client.Send(&commands.HttpRequest{Uuid: "a", Method: "GET"}); err != nil {
+		t.Fatal(err)
+	}
+	rec.Expect(t, &commands.HttpRequest{Uuid: "a", Method: "GET"})
+}
+
+func TestPeer(t *testing.T) {
+	conn, peer := tunltest.NewPeer(nil)
+	defer peer.Close()
+
+	rec := tunltest.NewRecorder()
+	conn.SetOnCommand(rec.Record)
+	go conn.HandleConnection()
+
+	if err := peer.Send(&commands.HttpRequest{Uuid: "a", Method: "GET"}); err != nil {
+		t.Fatal(err)
+	}
+	rec.Expect(t, &commands.HttpRequest{Uuid: "a", Method: "GET"})
+
+	if _, err := conn.Send(&commands.HttpResponse{Uuid: "a", Status: 200}); err != nil {
+		t.Fatal(err)
+	}
+	peer.Expect(t, &commands.HttpResponse{Uuid: "a", Status: 200})
+
+	conn.Close()
+	peer.ExpectClosed(t)
+}
+
+func TestPeerCompression(t *testing.T) {
+	conn, peer := tunltest.NewPeer(nil)
+	defer peer.Close()
+	defer conn.Close()
+
+	if err := peer.SetCompression("bogus"); err != tunl.ErrorUnknownCompression {
+		t.Fatalf("unknown compressor: %v", err)
+	}
+	for _, err := range []error{conn.SetCompression("gzip"), peer.SetCompression("gzip")} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := tunltest.NewRecorder()
+	conn.SetOnCommand(rec.Record)
+	go conn.HandleConnection()
+
+	chunk := &commands.BodyChunk{Uuid: "a", Body: bytes.Repeat([]byte("tunnel "), 1000)}
+	if err := peer.Send(chunk); err != nil {
+		t.Fatal(err)
+	}
+	rec.Expect(t, chunk)
+
+	if _, err := conn.Send(chunk); err != nil {
+		t.Fatal(err)
+	}
+	peer.Expect(t, chunk)
+}
+
+func TestPeerMalformedFrame(t *testing.T) {
+	cfg := tunl.DefaultConfig()
+	cfg.MaxFrameSize = 1 << 10
+	conn, peer := tunltest.NewPeer(cfg)
+	defer peer.Close()
+
+	rec := tunltest.NewRecorder()
+	conn.SetOnError(rec.RecordError)
+	go conn.HandleConnection()
+
+	if err := peer.WriteRaw(tunltest.Prefix(tunl.FramePrefixSize + 1<<20)); err != nil {
+		t.Fatal(err)
+	}
+	if errs := rec.WaitError(t, 1); errs[0] != tunl.ErrorFrameTooLarge {
+		t.Fatalf("error: %v", errs[0])
+	}
+}
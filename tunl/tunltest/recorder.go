@@ -0,0 +1,119 @@
+package tunltest
+
+import (
+	"github.com/black40x/tunl-core/commands"
+	"google.golang.org/protobuf/proto"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Recorder collects the commands and errors delivered to a TunlConn. Hook
+// it up with SetOnCommand(r.Record) and SetOnError(r.RecordError).
+type Recorder struct {
+	Timeout time.Duration
+	mu      sync.Mutex
+	cmds    []*commands.Transfer
+	errs    []error
+	next    int
+	changed chan struct{}
+}
+
+func NewRecorder() *Recorder {
+	return &Recorder{
+		Timeout: DefaultTimeout,
+		changed: make(chan struct{}),
+	}
+}
+
+func (r *Recorder) notify() {
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// Record stores a copy of cmd, so it also works with Config.ReuseTransfer.
+func (r *Recorder) Record(cmd *commands.Transfer) {
+	c := proto.Clone(cmd).(*commands.Transfer)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.cmds = append(r.cmds, c)
+	r.notify()
+}
+
+func (r *Recorder) RecordError(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.errs = append(r.errs, err)
+	r.notify()
+}
+
+func (r *Recorder) Commands() []*commands.Transfer {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]*commands.Transfer(nil), r.cmds...)
+}
+
+func (r *Recorder) Errors() []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]error(nil), r.errs...)
+}
+
+func (r *Recorder) wait(t testing.TB, ready func() bool) {
+	t.Helper()
+
+	timeout := time.After(r.Timeout)
+	for {
+		r.mu.Lock()
+		ok := ready()
+		changed := r.changed
+		r.mu.Unlock()
+		if ok {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-timeout:
+			t.Fatalf("timed out after %s", r.Timeout)
+		}
+	}
+}
+
+// Next waits for the next command that has not been returned yet.
+func (r *Recorder) Next(t testing.TB) *commands.Transfer {
+	t.Helper()
+
+	r.wait(t, func() bool { return r.next < len(r.cmds) })
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := r.cmds[r.next]
+	r.next++
+
+	return c
+}
+
+// Expect fails the test unless the next commands equal want, in order.
+func (r *Recorder) Expect(t testing.TB, want ...proto.Message) {
+	t.Helper()
+
+	for _, w := range want {
+		expectMessage(t, r.Next(t), w)
+	}
+}
+
+// WaitError waits until at least n errors have been recorded.
+func (r *Recorder) WaitError(t testing.TB, n int) []error {
+	t.Helper()
+
+	r.wait(t, func() bool { return len(r.errs) >= n })
+
+	return r.Errors()
+}
@@ -0,0 +1,75 @@
+package tunltest_test
+
+import (
+	"errors"
+	"github.com/black40x/tunl-core/commands"
+	"github.com/black40x/tunl-core/tunl/tunltest"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestRecorderCopies(t *testing.T) {
+	r := tunltest.NewRecorder()
+
+	trans := commands.NewTransfer(&commands.BodyChunk{Uuid: "a", Body: []byte("x")})
+	r.Record(trans)
+	trans.GetBodyChunk().Body[0] = 'y'
+	trans.GetBodyChunk().Uuid = "b"
+
+	r.Expect(t, &commands.BodyChunk{Uuid: "a", Body: []byte("x")})
+	if n := len(r.Commands()); n != 1 {
+		t.Fatalf("%d commands, want 1", n)
+	}
+}
+
+func TestRecorderWaits(t *testing.T) {
+	r := tunltest.NewRecorder()
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		r.Record(commands.NewTransfer(&commands.HttpRequest{Uuid: "a"}))
+		r.Record(commands.NewTransfer(&commands.BodyChunk{Uuid: "a", Eof: true}))
+		r.RecordError(errors.New("first"))
+		r.RecordError(errors.New("second"))
+	}()
+
+	r.Expect(t,
+		&commands.HttpRequest{Uuid: "a"},
+		&commands.BodyChunk{Uuid: "a", Eof: true},
+	)
+	if errs := r.WaitError(t, 2); len(errs) != 2 || errs[1].Error() != "second" {
+		t.Fatalf("errors: %v", errs)
+	}
+}
+
+func TestRecorderTimeout(t *testing.T) {
+	r := tunltest.NewRecorder()
+	r.Timeout = 10 * time.Millisecond
+
+	ft := &fatalRecorder{TB: t}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.Next(ft)
+	}()
+	<-done
+
+	if !ft.failed {
+		t.Fatal("Next on an empty recorder did not fail")
+	}
+}
+
+// fatalRecorder notes a call to Fatalf instead of failing the test, which
+// lets tests check that a helper gives up.
+type fatalRecorder struct {
+	testing.TB
+	failed bool
+}
+
+func (f *fatalRecorder) Helper() {}
+
+func (f *fatalRecorder) Fatalf(format string, args ...interface{}) {
+	f.failed = true
+	runtime.Goexit()
+}
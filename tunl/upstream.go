@@ -0,0 +1,56 @@
+package tunl
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/black40x/tunl-core/commands"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// UpstreamErrorCode classifies an error returned while proxying a request to
+// the local service.
+func UpstreamErrorCode(err error) int32 {
+	var (
+		dnsErr    *net.DNSError
+		maxBytes  *http.MaxBytesError
+		recordErr tls.RecordHeaderError
+		authority x509.UnknownAuthorityError
+		hostname  x509.HostnameError
+		invalid   x509.CertificateInvalidError
+		netErr    net.Error
+	)
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &dnsErr):
+		return ErrorUpstreamDNS
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrorUpstreamRefused
+	case errors.As(err, &maxBytes), errors.Is(err, ErrorFrameTooLarge):
+		return ErrorUpstreamBodyTooLarge
+	case errors.As(err, &recordErr), errors.As(err, &authority),
+		errors.As(err, &hostname), errors.As(err, &invalid):
+		return ErrorUpstreamTLS
+	case errors.Is(err, context.DeadlineExceeded),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return ErrorUpstreamTimeout
+	}
+
+	return ErrorClientResponse
+}
+
+// UpstreamErrorResponse builds the response to req for an upstream failure
+// using DefaultPages.
+func UpstreamErrorResponse(req *commands.HttpRequest, code int32) (*commands.HttpResponse, *commands.BodyChunk) {
+	return DefaultPages.Response(req, code)
+}
+
+// SendUpstreamError answers req with the error page for code.
+func (t *TunlConn) SendUpstreamError(req *commands.HttpRequest, code int32) error {
+	return DefaultPages.Send(t, req, code)
+}
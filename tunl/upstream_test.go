@@ -0,0 +1,75 @@
+package tunl_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"github.com/black40x/tunl-core/tunl"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+)
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// clientError wraps err the way http.Client reports transport failures.
+func clientError(err error) error {
+	return &url.Error{Op: "Get", URL: "http://127.0.0.1:8080/", Err: err}
+}
+
+func TestUpstreamErrorCode(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+	tests := []struct {
+		name string
+		err  error
+		want int32
+	}{
+		{"nil", nil, 0},
+		{"refused", clientError(refused), tunl.ErrorUpstreamRefused},
+		{"deadline", clientError(context.DeadlineExceeded), tunl.ErrorUpstreamTimeout},
+		{"net timeout", clientError(&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}), tunl.ErrorUpstreamTimeout},
+		{"dns", clientError(&net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "local.test", IsNotFound: true}}), tunl.ErrorUpstreamDNS},
+		{"dns timeout", clientError(&net.DNSError{Err: "timeout", Name: "local.test", IsTimeout: true}), tunl.ErrorUpstreamDNS},
+		{"tls record", clientError(tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}), tunl.ErrorUpstreamTLS},
+		{"tls authority", clientError(&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}), tunl.ErrorUpstreamTLS},
+		{"tls hostname", clientError(x509.HostnameError{Host: "local.test"}), tunl.ErrorUpstreamTLS},
+		{"tls invalid", clientError(x509.CertificateInvalidError{Reason: x509.Expired}), tunl.ErrorUpstreamTLS},
+		{"max bytes", fmt.Errorf("read body: %w", &http.MaxBytesError{Limit: 10}), tunl.ErrorUpstreamBodyTooLarge},
+		{"frame too large", fmt.Errorf("read body: %w", tunl.ErrorFrameTooLarge), tunl.ErrorUpstreamBodyTooLarge},
+		{"other", errors.New("connection reset"), tunl.ErrorClientResponse},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tunl.UpstreamErrorCode(tt.err); got != tt.want {
+				t.Fatalf("UpstreamErrorCode(%v) = %d, want %d", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUpstreamErrorCodeDial(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	_, err = net.Dial("tcp", addr)
+	if err == nil {
+		t.Skip("closed port accepted a connection")
+	}
+	if got := tunl.UpstreamErrorCode(err); got != tunl.ErrorUpstreamRefused {
+		t.Fatalf("UpstreamErrorCode(%v) = %d, want %d", err, got, tunl.ErrorUpstreamRefused)
+	}
+}
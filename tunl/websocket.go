@@ -0,0 +1,470 @@
+package tunl
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const WebSocketProtocol = "tunl"
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+
+	wsFin  = 0x80
+	wsMask = 0x80
+)
+
+const wsFlagCompressed = 0x01
+
+var (
+	ErrorWebSocketHandshake = errors.New("websocket handshake failed")
+	ErrorWebSocketProtocol  = errors.New("websocket protocol error")
+)
+
+type WebSocketOptions struct {
+	// Header is sent with the upgrade request.
+	Header http.Header
+	// TLSConfig is used for wss:// URLs.
+	TLSConfig *tls.Config
+	// Proxy selects the HTTP proxy for the request, http.ProxyFromEnvironment
+	// by default.
+	Proxy func(*http.Request) (*url.URL, error)
+	// DialContext opens the TCP connection to the server or the proxy.
+	DialContext func(ctx context.Context, network, addr string) (net.Conn, error)
+	Config      *Config
+}
+
+// WebSocketTransport carries one frame per binary WebSocket message, so the
+// control connection can pass through HTTP proxies and CDNs that only allow
+// HTTPS. The first byte of every message holds the frame flags.
+type WebSocketTransport struct {
+	conn      io.ReadWriteCloser
+	netConn   net.Conn
+	r         *bufio.Reader
+	w         *bufio.Writer
+	client    bool
+	maxSize   int
+	buf       []byte
+	wmu       sync.Mutex
+	scratch   []byte
+	closeOnce sync.Once
+}
+
+func newWebSocketTransport(conn io.ReadWriteCloser, netConn net.Conn, r *bufio.Reader, client bool, cfg *Config) *WebSocketTransport {
+	cfg = cfg.withDefaults()
+	if r == nil {
+		r = bufio.NewReaderSize(conn, cfg.ReadBufferSize)
+	}
+	return &WebSocketTransport{
+		conn:    conn,
+		netConn: netConn,
+		r:       r,
+		w:       bufio.NewWriterSize(conn, cfg.WriteBufferSize),
+		client:  client,
+		maxSize: cfg.MaxFrameSize + 1,
+	}
+}
+
+func websocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DialWebSocket opens a tunl control connection over WebSocket. ws:// and
+// wss:// URLs are accepted, and proxies from the environment are honored
+// unless opts says otherwise.
+func DialWebSocket(ctx context.Context, rawURL string, opts *WebSocketOptions) (*WebSocketTransport, error) {
+	if opts == nil {
+		opts = &WebSocketOptions{}
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	case "http", "https":
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme: %s", u.Scheme)
+	}
+
+	nonce := make([]byte, 16)
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range opts.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Protocol", WebSocketProtocol)
+
+	proxy := opts.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	dial := opts.DialContext
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: 30 * time.Second}).DialContext
+	}
+	tlsConfig := opts.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+
+	var netConn net.Conn
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: proxy,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				c, err := dial(ctx, network, addr)
+				netConn = c
+				return c, err
+			},
+			TLSClientConfig:   tlsConfig,
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols ||
+		!headerContains(resp.Header, "Upgrade", "websocket") ||
+		resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%w: %s", ErrorWebSocketHandshake, resp.Status)
+	}
+
+	rwc, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		resp.Body.Close()
+		return nil, ErrorWebSocketHandshake
+	}
+
+	return newWebSocketTransport(rwc, netConn, nil, true, opts.Config), nil
+}
+
+// AcceptWebSocket upgrades an incoming HTTP request to a WebSocket transport.
+// On failure an error response has already been written.
+func AcceptWebSocket(w http.ResponseWriter, r *http.Request, cfg *Config) (*WebSocketTransport, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet ||
+		!headerContains(r.Header, "Connection", "upgrade") ||
+		!headerContains(r.Header, "Upgrade", "websocket") ||
+		key == "" {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return nil, ErrorWebSocketHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "unsupported websocket version", http.StatusUpgradeRequired)
+		return nil, ErrorWebSocketHandshake
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, ErrorWebSocketHandshake
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n"
+	if headerContains(r.Header, "Sec-WebSocket-Protocol", WebSocketProtocol) {
+		resp += "Sec-WebSocket-Protocol: " + WebSocketProtocol + "\r\n"
+	}
+	resp += "\r\n"
+
+	if _, err = brw.WriteString(resp); err == nil {
+		err = brw.Flush()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return newWebSocketTransport(conn, conn, brw.Reader, false, cfg), nil
+}
+
+func (ws *WebSocketTransport) ReadFrame() (Frame, error) {
+	data, err := ws.readMessage()
+	if err != nil {
+		return Frame{}, err
+	}
+	if len(data) == 0 {
+		return Frame{}, ErrorWebSocketProtocol
+	}
+
+	return Frame{Payload: data[1:], Compressed: data[0]&wsFlagCompressed != 0}, nil
+}
+
+func (ws *WebSocketTransport) readMessage() ([]byte, error) {
+	ws.buf = ws.buf[:0]
+	started := false
+
+	for {
+		var head [2]byte
+		if _, err := io.ReadFull(ws.r, head[:]); err != nil {
+			return nil, err
+		}
+		fin := head[0]&wsFin != 0
+		op := head[0] & 0x0f
+		masked := head[1]&wsMask != 0
+		if head[0]&0x70 != 0 || masked == ws.client {
+			return nil, ErrorWebSocketProtocol
+		}
+
+		size := uint64(head[1] & 0x7f)
+		switch size {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+				return nil, err
+			}
+			size = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(ws.r, ext[:]); err != nil {
+				return nil, err
+			}
+			size = binary.BigEndian.Uint64(ext[:])
+			if size>>63 != 0 {
+				return nil, ErrorWebSocketProtocol
+			}
+		}
+
+		var mask [4]byte
+		if masked {
+			if _, err := io.ReadFull(ws.r, mask[:]); err != nil {
+				return nil, err
+			}
+		}
+
+		if op >= wsClose {
+			if !fin || size > 125 {
+				return nil, ErrorWebSocketProtocol
+			}
+			payload := make([]byte, size)
+			if _, err := io.ReadFull(ws.r, payload); err != nil {
+				return nil, err
+			}
+			if masked {
+				maskBytes(mask, 0, payload)
+			}
+			switch op {
+			case wsPing:
+				ws.writeControl(wsPong, payload)
+			case wsClose:
+				ws.writeControl(wsClose, nil)
+				return nil, io.EOF
+			}
+			continue
+		}
+
+		switch op {
+		case wsBinary, wsText:
+			if started {
+				return nil, ErrorWebSocketProtocol
+			}
+			started = true
+		case wsContinuation:
+			if !started {
+				return nil, ErrorWebSocketProtocol
+			}
+		default:
+			return nil, ErrorWebSocketProtocol
+		}
+
+		if size > uint64(ws.maxSize-len(ws.buf)) {
+			return nil, ErrorFrameTooLarge
+		}
+		// Grow geometrically, so a message split into many small fragments
+		// is not copied again for every one of them.
+		start := len(ws.buf)
+		ws.buf = slices.Grow(ws.buf, int(size))[:start+int(size)]
+		if _, err := io.ReadFull(ws.r, ws.buf[start:]); err != nil {
+			return nil, err
+		}
+		if masked {
+			maskBytes(mask, 0, ws.buf[start:])
+		}
+
+		if fin {
+			return ws.buf, nil
+		}
+	}
+}
+
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= key[pos&3]
+		pos++
+	}
+	return pos
+}
+
+func (ws *WebSocketTransport) WriteFrame(f Frame) error {
+	var flags byte
+	if f.Compressed {
+		flags |= wsFlagCompressed
+	}
+
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+
+	return ws.writeMessage(wsBinary, []byte{flags}, f.Payload)
+}
+
+func (ws *WebSocketTransport) writeControl(op byte, payload []byte) error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+
+	err := ws.writeMessage(op, payload)
+	if err == nil {
+		err = ws.w.Flush()
+	}
+	return err
+}
+
+func (ws *WebSocketTransport) writeMessage(op byte, parts ...[]byte) error {
+	size := 0
+	for _, p := range parts {
+		size += len(p)
+	}
+
+	head := make([]byte, 2, 14)
+	head[0] = wsFin | op
+	switch {
+	case size <= 125:
+		head[1] = byte(size)
+	case size <= 0xffff:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(size))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(size))
+	}
+
+	var mask [4]byte
+	if ws.client {
+		head[1] |= wsMask
+		if _, err := io.ReadFull(rand.Reader, mask[:]); err != nil {
+			return err
+		}
+		head = append(head, mask[:]...)
+	}
+
+	if _, err := ws.w.Write(head); err != nil {
+		return err
+	}
+
+	pos := 0
+	for _, p := range parts {
+		if !ws.client {
+			if _, err := ws.w.Write(p); err != nil {
+				return err
+			}
+			continue
+		}
+		if ws.scratch == nil {
+			ws.scratch = make([]byte, 4<<10)
+		}
+		for len(p) > 0 {
+			n := copy(ws.scratch, p)
+			pos = maskBytes(mask, pos, ws.scratch[:n])
+			if _, err := ws.w.Write(ws.scratch[:n]); err != nil {
+				return err
+			}
+			p = p[n:]
+		}
+	}
+
+	return nil
+}
+
+func (ws *WebSocketTransport) Flush() error {
+	ws.wmu.Lock()
+	defer ws.wmu.Unlock()
+
+	return ws.w.Flush()
+}
+
+func (ws *WebSocketTransport) SetWriteDeadline(t time.Time) error {
+	if ws.netConn != nil {
+		return ws.netConn.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// Close sends a close message when the connection is not busy writing and
+// closes the underlying connection.
+func (ws *WebSocketTransport) Close() error {
+	var err error
+	ws.closeOnce.Do(func() {
+		if ws.wmu.TryLock() {
+			if ws.writeMessage(wsClose, []byte{0x03, 0xe8}) == nil {
+				ws.w.Flush()
+			}
+			ws.wmu.Unlock()
+		}
+		err = ws.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,138 @@
+package tunl
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"runtime"
+	"testing"
+)
+
+type readOnlyConn struct {
+	io.Reader
+}
+
+func (readOnlyConn) Write(p []byte) (int, error) { return len(p), nil }
+
+func (readOnlyConn) Close() error { return nil }
+
+// maskedHeader returns the head of a masked client frame with an all-zero
+// mask, so the payload goes on the wire as is.
+func maskedHeader(b0 byte, size uint64) []byte {
+	h := []byte{b0}
+	switch {
+	case size < 126:
+		h = append(h, wsMask|byte(size))
+	case size <= 0xffff:
+		h = append(h, wsMask|126)
+		h = binary.BigEndian.AppendUint16(h, uint16(size))
+	default:
+		h = append(h, wsMask|127)
+		h = binary.BigEndian.AppendUint64(h, size)
+	}
+	return append(h, 0, 0, 0, 0)
+}
+
+func TestWebSocketReadFrameLength(t *testing.T) {
+	first := append(maskedHeader(wsBinary, 10), make([]byte, 10)...)
+
+	tests := []struct {
+		name string
+		size uint64
+		want error
+	}{
+		{"overflow", 1<<64 - 5, ErrorWebSocketProtocol},
+		{"top bit", 1 << 63, ErrorWebSocketProtocol},
+		{"too large", 1<<63 - 1, ErrorFrameTooLarge},
+		{"over limit", DefaultMaxFrameSize, ErrorFrameTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := append(append([]byte(nil), first...), maskedHeader(wsFin|wsContinuation, tt.size)...)
+			ws := newWebSocketTransport(readOnlyConn{bytes.NewReader(data)}, nil, nil, false, nil)
+
+			if _, err := ws.ReadFrame(); err != tt.want {
+				t.Fatalf("ReadFrame() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebSocketReadFrameFragments(t *testing.T) {
+	var data []byte
+	data = append(data, maskedHeader(wsBinary, 3)...)
+	data = append(data, wsFlagCompressed, 'a', 'b')
+	data = append(data, maskedHeader(wsContinuation, 2)...)
+	data = append(data, 'c', 'd')
+	data = append(data, maskedHeader(wsFin|wsContinuation, 1)...)
+	data = append(data, 'e')
+
+	ws := newWebSocketTransport(readOnlyConn{bytes.NewReader(data)}, nil, nil, false, nil)
+	f, err := ws.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(f.Payload) != "abcde" || !f.Compressed {
+		t.Fatalf("ReadFrame() = %q compressed=%v", f.Payload, f.Compressed)
+	}
+}
+
+func TestWebSocketReadFrameManyFragments(t *testing.T) {
+	const fragments = 2000
+
+	var data []byte
+	data = append(data, maskedHeader(wsBinary, 1)...)
+	data = append(data, 0)
+	for i := 1; i < fragments; i++ {
+		b0 := byte(wsContinuation)
+		if i == fragments-1 {
+			b0 |= wsFin
+		}
+		data = append(data, maskedHeader(b0, 8)...)
+		data = append(data, "fragment"...)
+	}
+
+	ws := newWebSocketTransport(readOnlyConn{bytes.NewReader(data)}, nil, nil, false, nil)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	f, err := ws.ReadFrame()
+	runtime.ReadMemStats(&after)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Payload) != 8*(fragments-1) {
+		t.Fatalf("payload of %d bytes", len(f.Payload))
+	}
+
+	// Copying the message every time it grows allocates about 16MB here.
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Fatalf("allocated %d bytes for a %d byte message", n, len(f.Payload))
+	}
+}
+
+// FuzzWebSocketReadFrame feeds arbitrary byte streams to both ends of a
+// WebSocket transport. Reading must end with an error instead of panicking,
+// and never return more than MaxFrameSize bytes.
+func FuzzWebSocketReadFrame(f *testing.F) {
+	const maxFrameSize = 1 << 16
+
+	f.Add(append(maskedHeader(wsFin|wsBinary, 3), 0, 'h', 'i'), false)
+	f.Add([]byte{wsFin | wsBinary, 3, wsFlagCompressed, 'h', 'i'}, true)
+	f.Add(append(maskedHeader(wsFin|wsPing, 2), 'p', 'p'), false)
+	f.Add(append(append(maskedHeader(wsBinary, 2), 0, 'a'), maskedHeader(wsFin|wsContinuation, 1<<64-5)...), false)
+	f.Add(append(maskedHeader(wsFin|wsBinary, maxFrameSize+2), 0), false)
+
+	f.Fuzz(func(t *testing.T, stream []byte, client bool) {
+		ws := newWebSocketTransport(readOnlyConn{bytes.NewReader(stream)}, nil, nil, client, &Config{MaxFrameSize: maxFrameSize})
+		for {
+			frame, err := ws.ReadFrame()
+			if err != nil {
+				return
+			}
+			if len(frame.Payload) > maxFrameSize {
+				t.Fatalf("read %d bytes, limit is %d", len(frame.Payload), maxFrameSize)
+			}
+		}
+	})
+}
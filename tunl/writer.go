@@ -0,0 +1,257 @@
+package tunl
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+type Stats struct {
+	QueueDepth     int
+	QueueHighWater int
+	FramesSent     uint64
+	BytesSent      uint64
+	FramesDropped  uint64
+}
+
+// frameWriter owns the outgoing side of a connection. Senders hand frames
+// to a bounded queue and a single goroutine passes them to the transport,
+// so a stalled peer only ever blocks that goroutine. Frames that queue up
+// while a write is in progress are coalesced into one flush.
+type frameWriter struct {
+	tr        Transport
+	queue     *frameQueue
+	policy    QueuePolicy
+	threshold int
+	interval  time.Duration
+	timeout   time.Duration
+	linger    atomic.Int64
+	pending   int
+	flushReq  chan chan error
+	flushC    <-chan time.Time
+	timer     *time.Timer
+	done      chan struct{}
+	onFail    func(err error)
+
+	framesSent    atomic.Uint64
+	bytesSent     atomic.Uint64
+	framesDropped atomic.Uint64
+}
+
+func newFrameWriter(tr Transport, cfg *Config, onFail func(err error)) *frameWriter {
+	return &frameWriter{
+		tr:        tr,
+		queue:     newFrameQueue(cfg.SendQueueSize),
+		policy:    cfg.SendQueuePolicy,
+		threshold: cfg.FlushThreshold,
+		interval:  cfg.FlushInterval,
+		timeout:   cfg.WriteTimeout,
+		flushReq:  make(chan chan error),
+		done:      make(chan struct{}),
+		onFail:    onFail,
+	}
+}
+
+// enqueue takes ownership of b and schedules it for writing. Data frames
+// with the same key are written in order.
+func (f *frameWriter) enqueue(b outFrame, prio priority, key string) (int, error) {
+	n := FramePrefixSize + len(*b.buf)
+
+	err := f.queue.push(b, prio, key)
+	if err == ErrorQueueFull {
+		switch f.policy {
+		case QueueBlock:
+			err = f.queue.pushWait(b, prio, key, f.timeout)
+		case QueueDisconnect:
+			err = ErrorSlowConsumer
+		}
+	}
+	if err != nil {
+		putBuffer(b.buf)
+		if err != ErrorConnectionClosed {
+			f.framesDropped.Add(1)
+		}
+		return 0, err
+	}
+
+	return n, nil
+}
+
+func (f *frameWriter) run() {
+	err := f.loop()
+	f.queue.close()
+	f.framesDropped.Add(uint64(f.queue.discard()))
+	f.stopTimer()
+	close(f.done)
+
+	if err != nil && f.onFail != nil {
+		f.onFail(err)
+	}
+}
+
+func (f *frameWriter) loop() error {
+	for {
+		if b, ok := f.queue.pop(); ok {
+			err := f.write(b)
+			putBuffer(b.buf)
+			if err != nil {
+				return err
+			}
+			if f.pending >= f.threshold {
+				if err = f.flush(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if f.pending > 0 {
+			if f.interval <= 0 || f.queue.isClosed() {
+				if err := f.flush(); err != nil {
+					return err
+				}
+			} else if f.flushC == nil {
+				f.timer = time.NewTimer(f.interval)
+				f.flushC = f.timer.C
+			}
+		}
+		if f.queue.isClosed() {
+			return nil
+		}
+
+		select {
+		case <-f.queue.ready:
+		case <-f.flushC:
+			f.flushC = nil
+			if err := f.flush(); err != nil {
+				return err
+			}
+		case reply := <-f.flushReq:
+			reply <- f.flushQueued()
+		}
+	}
+}
+
+func (f *frameWriter) setDeadline() {
+	d, ok := f.tr.(deadlineWriter)
+	if !ok {
+		return
+	}
+
+	var deadline time.Time
+	if f.timeout > 0 {
+		deadline = time.Now().Add(f.timeout)
+	}
+	if l := f.linger.Load(); l != 0 {
+		if linger := time.Unix(0, l); deadline.IsZero() || linger.Before(deadline) {
+			deadline = linger
+		}
+	}
+	d.SetWriteDeadline(deadline)
+}
+
+func (f *frameWriter) write(b outFrame) error {
+	if f.pending == 0 {
+		f.setDeadline()
+	}
+	err := f.tr.WriteFrame(Frame{Payload: *b.buf, Compressed: b.compressed})
+	if err != nil {
+		return writeError(err)
+	}
+
+	f.pending += FramePrefixSize + len(*b.buf)
+	f.framesSent.Add(1)
+	f.bytesSent.Add(uint64(FramePrefixSize + len(*b.buf)))
+
+	return nil
+}
+
+func (f *frameWriter) flush() error {
+	f.stopTimer()
+	if f.pending == 0 {
+		return nil
+	}
+	f.pending = 0
+
+	fl, ok := f.tr.(Flusher)
+	if !ok {
+		return nil
+	}
+	f.setDeadline()
+	return writeError(fl.Flush())
+}
+
+// flushQueued writes whatever is still queued before flushing, since frames
+// may arrive between the last pop and a Flush request.
+func (f *frameWriter) flushQueued() error {
+	for {
+		b, ok := f.queue.pop()
+		if !ok {
+			return f.flush()
+		}
+		err := f.write(b)
+		putBuffer(b.buf)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (f *frameWriter) stopTimer() {
+	if f.timer != nil {
+		f.timer.Stop()
+		f.timer = nil
+		f.flushC = nil
+	}
+}
+
+func writeError(err error) error {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return ErrorWriteTimeout
+	}
+	return err
+}
+
+func (f *frameWriter) Flush() error {
+	reply := make(chan error, 1)
+	select {
+	case f.flushReq <- reply:
+	case <-f.done:
+		return ErrorConnectionClosed
+	}
+
+	select {
+	case err := <-reply:
+		return err
+	case <-f.done:
+		return ErrorConnectionClosed
+	}
+}
+
+// close stops accepting frames and gives the writer up to linger to push
+// out what is already queued.
+func (f *frameWriter) close(linger time.Duration) {
+	f.linger.Store(time.Now().Add(linger).UnixNano())
+	if d, ok := f.tr.(deadlineWriter); ok {
+		d.SetWriteDeadline(time.Now().Add(linger))
+	}
+	f.queue.close()
+
+	select {
+	case <-f.done:
+	case <-time.After(linger):
+	}
+}
+
+func (f *frameWriter) stats() Stats {
+	depth, highWater := f.queue.depth()
+	return Stats{
+		QueueDepth:     depth,
+		QueueHighWater: highWater,
+		FramesSent:     f.framesSent.Load(),
+		BytesSent:      f.bytesSent.Load(),
+		FramesDropped:  f.framesDropped.Load(),
+	}
+}
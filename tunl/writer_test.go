@@ -0,0 +1,310 @@
+package tunl_test
+
+import (
+	"encoding/binary"
+	"github.com/black40x/tunl-core/commands"
+	"github.com/black40x/tunl-core/tunl"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// writeRecorder is a connection that reports every Write it gets as one
+// slice, so tests can see how frames were batched.
+type writeRecorder struct {
+	writes chan []byte
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newWriteRecorder() *writeRecorder {
+	return &writeRecorder{writes: make(chan []byte, 64), closed: make(chan struct{})}
+}
+
+func (w *writeRecorder) Read(p []byte) (int, error) {
+	<-w.closed
+	return 0, io.EOF
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	w.writes <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func (w *writeRecorder) Close() error {
+	w.once.Do(func() { close(w.closed) })
+	return nil
+}
+
+func (w *writeRecorder) next(t *testing.T, timeout time.Duration) []byte {
+	t.Helper()
+
+	select {
+	case b := <-w.writes:
+		return b
+	case <-time.After(timeout):
+		t.Fatalf("no write within %v", timeout)
+		return nil
+	}
+}
+
+func (w *writeRecorder) expectNone(t *testing.T, wait time.Duration) {
+	t.Helper()
+
+	select {
+	case b := <-w.writes:
+		t.Fatalf("unexpected write of %d bytes", len(b))
+	case <-time.After(wait):
+	}
+}
+
+// countFrames counts the length-prefixed frames in b.
+func countFrames(t *testing.T, b []byte) int {
+	t.Helper()
+
+	n := 0
+	for len(b) > 0 {
+		if len(b) < tunl.FramePrefixSize {
+			t.Fatalf("truncated prefix")
+		}
+		size := int(binary.BigEndian.Uint32(b) &^ tunl.FrameCompressed)
+		if size < tunl.FramePrefixSize || size > len(b) {
+			t.Fatalf("bad frame size %d", size)
+		}
+		b = b[size:]
+		n++
+	}
+	return n
+}
+
+func recordedConn(cfg *tunl.Config) (*tunl.TunlConn, *writeRecorder) {
+	w := newWriteRecorder()
+	return tunl.NewTunlConnTransport(tunl.NewStreamTransport(w, cfg), cfg), w
+}
+
+func TestWriterCoalesces(t *testing.T) {
+	cfg := tunl.DefaultConfig()
+	cfg.FlushInterval = 100 * time.Millisecond
+	c, w := recordedConn(cfg)
+	defer c.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := c.Send(&commands.BodyChunk{Uuid: "a", Body: []byte("small")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := countFrames(t, w.next(t, time.Second)); n != 5 {
+		t.Fatalf("first write held %d frames, want 5", n)
+	}
+	w.expectNone(t, 2*cfg.FlushInterval)
+}
+
+func TestWriterFlushThreshold(t *testing.T) {
+	cfg := tunl.DefaultConfig()
+	cfg.FlushInterval = time.Hour
+	cfg.FlushThreshold = 1 << 10
+	c, w := recordedConn(cfg)
+	defer c.Close()
+
+	if _, err := c.Send(&commands.BodyChunk{Uuid: "a", Body: []byte("small")}); err != nil {
+		t.Fatal(err)
+	}
+	w.expectNone(t, 50*time.Millisecond)
+
+	if _, err := c.Send(&commands.BodyChunk{Uuid: "a", Body: make([]byte, 2<<10)}); err != nil {
+		t.Fatal(err)
+	}
+	if n := countFrames(t, w.next(t, time.Second)); n != 2 {
+		t.Fatalf("flush held %d frames, want 2", n)
+	}
+}
+
+func TestWriterFlush(t *testing.T) {
+	cfg := tunl.DefaultConfig()
+	cfg.FlushInterval = time.Hour
+	c, w := recordedConn(cfg)
+	defer c.Close()
+
+	for i := 0; i < 3; i++ {
+		c.Send(&commands.BodyChunk{Uuid: "a", Body: []byte("small")})
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if n := countFrames(t, w.next(t, time.Second)); n != 3 {
+		t.Fatalf("Flush wrote %d frames, want 3", n)
+	}
+}
+
+// stalledConn returns a connection whose peer never reads, after the writer
+// has taken one frame and the queue holds SendQueueSize more.
+func stalledConn(t *testing.T, cfg *tunl.Config) (*tunl.TunlConn, tunl.Transport) {
+	t.Helper()
+
+	a, b := tunl.Pipe()
+	c := tunl.NewTunlConnTransport(a, cfg)
+
+	if _, err := c.Send(&commands.BodyChunk{Uuid: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	waitStats(t, c, func(s tunl.Stats) bool { return s.QueueDepth == 0 })
+	for i := 0; i < cfg.SendQueueSize; i++ {
+		if _, err := c.Send(&commands.BodyChunk{Uuid: "a"}); err != nil {
+			t.Fatalf("Send %d: %v", i, err)
+		}
+	}
+
+	return c, b
+}
+
+func waitStats(t *testing.T, c *tunl.TunlConn, ok func(tunl.Stats) bool) tunl.Stats {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		s := c.Stats()
+		if ok(s) {
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("stats never matched: %+v", s)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestQueueDrop(t *testing.T) {
+	cfg := tunl.DefaultConfig()
+	cfg.SendQueueSize = 2
+	cfg.SendQueuePolicy = tunl.QueueDrop
+	c, peer := stalledConn(t, cfg)
+	defer c.Close()
+	defer peer.Close()
+
+	if _, err := c.Send(&commands.BodyChunk{Uuid: "a"}); err != tunl.ErrorQueueFull {
+		t.Fatalf("Send on full queue: %v", err)
+	}
+	s := c.Stats()
+	if s.QueueDepth != 2 || s.QueueHighWater != 2 || s.FramesDropped != 1 {
+		t.Fatalf("stats after drop: %+v", s)
+	}
+	if c.Closed() {
+		t.Fatal("QueueDrop closed the connection")
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := peer.ReadFrame(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s = waitStats(t, c, func(s tunl.Stats) bool { return s.FramesSent == 3 })
+	if s.QueueDepth != 0 || s.FramesDropped != 1 || s.BytesSent == 0 {
+		t.Fatalf("stats after drain: %+v", s)
+	}
+}
+
+func TestQueueDisconnect(t *testing.T) {
+	cfg := tunl.DefaultConfig()
+	cfg.SendQueueSize = 2
+	cfg.SendQueuePolicy = tunl.QueueDisconnect
+	c, _ := stalledConn(t, cfg)
+
+	errs := make(chan error, 4)
+	c.SetOnError(func(err error) { errs <- err })
+
+	if _, err := c.Send(&commands.BodyChunk{Uuid: "a"}); err != tunl.ErrorSlowConsumer {
+		t.Fatalf("Send on full queue: %v", err)
+	}
+	if !c.Closed() {
+		t.Fatal("connection still open")
+	}
+	if err := <-errs; err != tunl.ErrorSlowConsumer {
+		t.Fatalf("reported error: %v", err)
+	}
+	if s := c.Stats(); s.FramesDropped < 1 {
+		t.Fatalf("stats: %+v", s)
+	}
+}
+
+func TestQueueBlock(t *testing.T) {
+	cfg := tunl.DefaultConfig()
+	cfg.SendQueueSize = 2
+	cfg.WriteTimeout = time.Second
+	c, peer := stalledConn(t, cfg)
+	defer c.Close()
+	defer peer.Close()
+
+	sent := make(chan error, 1)
+	go func() {
+		_, err := c.Send(&commands.BodyChunk{Uuid: "a"})
+		sent <- err
+	}()
+
+	select {
+	case err := <-sent:
+		t.Fatalf("Send did not block: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := peer.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-sent:
+		if err != nil {
+			t.Fatalf("blocked Send: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Send still blocked after the peer read")
+	}
+	if s := c.Stats(); s.FramesDropped != 0 {
+		t.Fatalf("stats: %+v", s)
+	}
+}
+
+func TestQueueBlockTimeout(t *testing.T) {
+	cfg := tunl.DefaultConfig()
+	cfg.SendQueueSize = 2
+	cfg.WriteTimeout = 50 * time.Millisecond
+	c, peer := stalledConn(t, cfg)
+	defer c.Close()
+	defer peer.Close()
+
+	start := time.Now()
+	if _, err := c.Send(&commands.BodyChunk{Uuid: "a"}); err != tunl.ErrorWriteTimeout {
+		t.Fatalf("Send on full queue: %v", err)
+	}
+	if d := time.Since(start); d < cfg.WriteTimeout {
+		t.Fatalf("Send gave up after %v", d)
+	}
+	if s := c.Stats(); s.FramesDropped != 1 || s.QueueDepth != 2 {
+		t.Fatalf("stats: %+v", s)
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	cfg := tunl.DefaultConfig()
+	cfg.WriteTimeout = 50 * time.Millisecond
+	a, b := net.Pipe()
+	defer b.Close()
+	c := tunl.NewTunlConnConfig(a, cfg)
+
+	errs := make(chan error, 1)
+	c.SetOnError(func(err error) { errs <- err })
+
+	if _, err := c.Send(&commands.BodyChunk{Uuid: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errs:
+		if err != tunl.ErrorWriteTimeout {
+			t.Fatalf("write error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stalled write never timed out")
+	}
+	waitStats(t, c, func(tunl.Stats) bool { return c.Closed() })
+}